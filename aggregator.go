@@ -1,16 +1,15 @@
-package main
+package aggregator
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,74 +17,24 @@ import (
 	"github.com/google/go-querystring/query"
 	jsoniter "github.com/json-iterator/go"
 	cache "github.com/patrickmn/go-cache"
-	"github.com/spf13/viper"
-	"github.com/throttled/throttled"
-	"github.com/throttled/throttled/store/memstore"
 	"github.com/valyala/fasthttp"
 )
 
+// Version is reported to pools and wallets
+const Version = "1.2.3"
+
 const (
-	version                = "1.2.3"
 	defaultCacheExpiration = 15 * time.Minute
 	minerCacheExpiration   = 60 * time.Second
 	exceededMinersPerIP    = 0
 	notUpdated             = 1
 	updated                = 2
 	remoteErr              = 3
-	wrongHeight            = 4
+	accountNotAllowed      = 5
 )
 
 // modules
 var jsonx = jsoniter.ConfigCompatibleWithStandardLibrary
-var client *fasthttp.Client
-var websocketClient *websocketAPI
-
-// config
-var listenAddr string
-var displayMiners bool
-var primarySubmitURL string
-var primTDL uint64
-var primBest uint64
-var primaryPassphrase string
-var primaryIPForwarding bool
-var primaryIgnoreWorseDeadlines bool
-var primaryAccountKey string
-var primaryws bool
-var secondarySubmitURL string
-var secTDL uint64
-var secBest uint64
-var secondaryPassphrase string
-var secondaryIPForwarding bool
-var secondaryIgnoreWorseDeadlines bool
-var secondaryAccountKey string
-var secondaryws bool
-var minerName string
-var minerAlias string
-
-var fileLogging bool
-
-var scanTime int64
-var rateLimit int
-var burstRate int
-var minersPerIP int
-var lieDetector bool
-
-// state variables
-var currentPrimChain atomicBool
-var currentHeight uint64
-var currentBaseTarget uint64 = 1
-var curPrimaryMiningInfo atomic.Value
-
-// last state variables
-var lastPrimChain atomicBool
-var lastHeight uint64
-var lastBaseTarget uint64 = 1
-var curSecondaryMiningInfo atomic.Value
-
-// caches
-var primc *cache.Cache
-var secc *cache.Cache
-var liarsCache *cache.Cache
 
 // errors
 var errSubmissionWrongFormatDeadline = errors.New("deadline submission has wrong format")
@@ -94,6 +43,324 @@ var errSubmissionWrongFormatBlockHeight = errors.New("blockheight submission has
 var errSubmissionWrongFormatAccountID = errors.New("account id submission has wrong format")
 var errTooManySubmissionsDifferentMiners = errors.New("too many submissions from different account ids by same ip")
 var errUnknownRequestType = errors.New("unknown request type")
+var errNoMiningInfo = errors.New("no mining info yet")
+
+// Aggregator serves miners with the mining info of a primary and an optional secondary chain
+// and forwards their deadlines, instances are independent of each other
+type Aggregator struct {
+	cfg           Config
+	prim          *chain
+	sec           *chain
+	websocket     *websocketAPI // nil -> no chain uses the websocket api
+	miners        *clientRegistry
+	limiter       *rateLimiter
+	notifications *notifier
+	tokens        map[string]*minerIdentity // token -> identity, nil if authentication is disabled
+	relays        map[string]*relay         // name -> child aggregator, nil if no relays are configured
+	liars         *cache.Cache
+	handler       fasthttp.RequestHandler // policy of ListenAddr, served by Handler and ServeHTTP
+	listeners     []*listener
+
+	// state variables
+	currentPrimChain  atomicBool
+	currentHeight     uint64
+	currentBaseTarget uint64
+
+	// last state variables
+	lastPrimChain  atomicBool
+	lastHeight     uint64
+	lastBaseTarget uint64
+
+	capacityPeak int64 // for capacity drop alerts, atomic
+
+	connsMu  sync.Mutex
+	conns    map[net.Conn]struct{} // connections of miners, closed on Stop
+	stop     chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context // cancelled on Stop, for background requests
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// chain is the state of the primary or the secondary chain
+type chain struct {
+	name       string
+	cfg        ChainConfig
+	ws         bool // mining info and submissions go through the websocket api
+	upstream   *upstream
+	accounts   accountFilter
+	health     *chainHealth
+	round      *roundTracker
+	forks      *forkDetector
+	stats      *deadlineStats
+	best       uint64       // best deadline forwarded for the current block, atomic
+	miningInfo atomic.Value // *miningInfo served to the miners
+	latest     atomic.Value // *miningInfo of the chain, not reset while the other chain is scanned
+	submitted  *cache.Cache // ip -> *ipData
+}
+
+// New creates an aggregator from cfg, nothing is connected or served before Start
+func New(cfg Config) (*Aggregator, error) {
+	a := &Aggregator{
+		cfg:               cfg,
+		currentBaseTarget: 1,
+		lastBaseTarget:    1,
+		liars:             cache.New(defaultCacheExpiration, defaultCacheExpiration),
+		conns:             make(map[net.Conn]struct{}),
+		stop:              make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	var err error
+	if a.notifications, err = newNotifier(cfg.Webhooks, cfg.MinerName); err != nil {
+		return nil, fmt.Errorf("notifications: %s", err)
+	}
+	a.miners = newClientRegistry(cfg.MaxMinerCapacity, a.notifications)
+	if a.tokens, err = loadMinerTokens(cfg.MinerTokens); err != nil {
+		return nil, fmt.Errorf("miner tokens: %s", err)
+	}
+	if a.tokens != nil {
+		logMain.Info("Miner authentication", "tokens", len(a.tokens))
+	}
+	if a.relays, err = newRelays(cfg.Relays); err != nil {
+		return nil, err
+	}
+	if a.prim, err = a.newChain("primary", cfg.Primary); err != nil {
+		return nil, fmt.Errorf("primary chain: %s", err)
+	}
+	if a.sec, err = a.newChain("secondary", cfg.Secondary); err != nil {
+		return nil, fmt.Errorf("secondary chain: %s", err)
+	}
+	if a.prim.ws && a.sec.ws {
+		return nil, errors.New("can only have a single websocket upstream")
+	}
+	if a.limiter, err = newRateLimiter(cfg); err != nil {
+		return nil, fmt.Errorf("rate limiter: %s", err)
+	}
+	l, err := a.newListener(ListenerConfig{Addr: cfg.ListenAddr, TLS: cfg.TLSCertFile != ""})
+	if err != nil {
+		return nil, err
+	}
+	a.handler = l.handler
+	if cfg.ListenAddr != "" {
+		a.listeners = append(a.listeners, l)
+	}
+	for i, lc := range cfg.Listeners {
+		l, err := a.newListener(lc)
+		if err != nil {
+			return nil, fmt.Errorf("listeners[%d]: %s", i, err)
+		}
+		a.listeners = append(a.listeners, l)
+	}
+	logMain.Info("Primary chain", "url", cfg.Primary.SubmitURL)
+	logMain.Info("Secondary chain", "url", cfg.Secondary.SubmitURL)
+	logMain.Info("Rate limiter", "limit", cfg.RateLimit, "burstRate", cfg.BurstRate)
+	return a, nil
+}
+
+func (a *Aggregator) newChain(name string, cfg ChainConfig) (*chain, error) {
+	c := &chain{
+		name:      name,
+		cfg:       cfg,
+		ws:        isWebsocketURL(cfg.SubmitURL),
+		accounts:  newAccountFilter(cfg.AllowedAccounts, cfg.DeniedAccounts),
+		health:    &chainHealth{name: name, notifications: a.notifications},
+		round:     &roundTracker{name: name, notifications: a.notifications, ctx: a.ctx, wg: &a.wg},
+		forks:     newForkDetector(name),
+		stats:     newDeadlineStats(a.cfg.StatsWindows),
+		best:      ^uint64(0),
+		submitted: cache.New(defaultCacheExpiration, defaultCacheExpiration),
+	}
+	var err error
+	if c.upstream, err = newUpstream(cfg.SubmitURL, cfg, a.miners); err != nil {
+		return nil, err
+	}
+	if cfg.WalletURL != "" {
+		if c.round.wallet, err = newUpstream(cfg.WalletURL, cfg, a.miners); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Relay {
+		if c.ws || a.cfg.RelayName == "" {
+			return nil, errors.New("relaying requires relayName and an http(s) submit url")
+		}
+		c.upstream.relayName, c.upstream.relayToken = a.cfg.RelayName, a.cfg.RelayToken
+	}
+	c.health.init(newStaleThreshold(cfg.BlockTime, cfg.StaleFactor))
+	return c, nil
+}
+
+// Start connects the websocket api, fetches the initial mining info, serves miners on ListenAddr and
+// Listeners and starts refreshing the mining info. On error everything started is stopped again.
+func (a *Aggregator) Start() (err error) {
+	defer func() {
+		if err != nil {
+			a.Stop()
+		}
+	}()
+	go a.notifications.run(a.stop)
+	if err := a.connect(); err != nil {
+		return err
+	}
+	if err := a.refreshMiningInfo(); err != nil {
+		return fmt.Errorf("get initial mining info: %s", err)
+	}
+	var tlsConfig *tls.Config
+	for _, l := range a.listeners {
+		if l.tls && tlsConfig == nil {
+			if tlsConfig, err = newTLSConfig(a.cfg.TLSCertFile, a.cfg.TLSKeyFile, a.cfg.TLSClientCAFile); err != nil {
+				return err
+			}
+			logTLS.Info("TLS enabled", "clientCertificates", a.cfg.TLSClientCAFile != "")
+		}
+		if err := a.serve(l, tlsConfig); err != nil {
+			return fmt.Errorf("listen on %s: %s", l.addr, err)
+		}
+	}
+	a.wg.Add(1)
+	go a.run()
+	return nil
+}
+
+// connect starts the websocket api of the chain using it
+func (a *Aggregator) connect() error {
+	c := a.prim
+	if a.sec.ws {
+		c = a.sec
+	}
+	if !c.ws {
+		return nil
+	}
+	dial, err := chainDial(c.cfg)
+	if err != nil {
+		return fmt.Errorf("%s chain: %s", c.name, err)
+	}
+	a.websocket = newWebsocketAPI(c.cfg.SubmitURL, c.cfg.AccountKey, a.cfg.MinerName, 0, a.cfg.WebsocketBatchWindow, dial)
+	a.websocket.Connect()
+	return nil
+}
+
+// run refreshes the mining info and expires miners and rate limits until Stop
+func (a *Aggregator) run() {
+	defer a.wg.Done()
+	refresh := time.NewTicker(1 * time.Second)
+	defer refresh.Stop()
+	expire := time.NewTicker(minerCacheExpiration / 2)
+	defer expire.Stop()
+	expireLimits := time.NewTicker(time.Minute)
+	defer expireLimits.Stop()
+	announce := time.NewTicker(relayAnnounceInterval)
+	defer announce.Stop()
+	for {
+		select {
+		case <-refresh.C:
+			_ = a.refreshMiningInfo()
+			a.checkStaleChains()
+			a.checkCapacityDrop()
+			if a.websocket != nil {
+				u := a.prim.upstream
+				if a.sec.ws {
+					u = a.sec.upstream
+				}
+				a.websocket.UpdateSize(u.reportedCapacity(0))
+			}
+		case <-expire.C:
+			a.miners.expire()
+		case <-expireLimits.C:
+			a.limiter.expire()
+		case <-announce.C:
+			a.announce()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// trackConn records the open connections of miners
+func (a *Aggregator) trackConn(conn net.Conn, state fasthttp.ConnState) {
+	a.connsMu.Lock()
+	defer a.connsMu.Unlock()
+	switch state {
+	case fasthttp.StateNew:
+		a.conns[conn] = struct{}{}
+	case fasthttp.StateClosed, fasthttp.StateHijacked:
+		delete(a.conns, conn)
+	}
+}
+
+// Stop closes the listener, the connections of miners and the websocket api and stops the background work.
+// A stopped aggregator can't be started again.
+func (a *Aggregator) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+		a.cancel()
+		for _, l := range a.listeners {
+			if l.ln != nil {
+				l.ln.Close()
+			}
+		}
+		a.connsMu.Lock()
+		for conn := range a.conns {
+			conn.Close()
+		}
+		a.connsMu.Unlock()
+		if a.websocket != nil {
+			a.websocket.Close()
+		}
+		a.wg.Wait()
+	})
+}
+
+// Addrs returns the addresses miners are served on, ListenAddr first and then Listeners in config order
+func (a *Aggregator) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, l := range a.listeners {
+		if l.ln != nil {
+			addrs = append(addrs, l.ln.Addr())
+		}
+	}
+	return addrs
+}
+
+// Handler returns the rate limited fasthttp handler serving miners with the policy of ListenAddr,
+// e.g. to serve them on own listeners
+func (a *Aggregator) Handler() fasthttp.RequestHandler {
+	return a.handler
+}
+
+// ServeHTTP serves miners through net/http
+func (a *Aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req fasthttp.Request
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.URL.RequestURI())
+	for name, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.SetBody(body)
+	}
+	remote := &net.TCPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote.IP = net.ParseIP(host)
+		remote.Port, _ = strconv.Atoi(port)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, remote, nil)
+	a.handler(&ctx)
+	ctx.Response.Header.VisitAll(func(key, value []byte) {
+		if string(key) != "Content-Length" {
+			w.Header().Add(string(key), string(value))
+		}
+	})
+	w.WriteHeader(ctx.Response.StatusCode())
+	w.Write(ctx.Response.Body())
+}
 
 type minerRound struct {
 	AccountID  uint64 `url:"accountId"`
@@ -122,83 +389,94 @@ type ipData struct {
 	sync.Mutex
 }
 
-func tryUpdateRound(w *http.ResponseWriter, r *http.Request, ip string, round *minerRound) int {
-	accountID := round.AccountID
+// roundChain finds the chain and base target of the block a round was mined for, ok is false if the round
+// is out-dated. Miners of a listener bound to a chain only mine its current block.
+func (a *Aggregator) roundChain(round *minerRound, bound *chain) (primChain bool, baseTarget uint64, ok bool) {
+	if bound != nil {
+		mi, _ := bound.latest.Load().(*miningInfo)
+		if mi == nil || round.Height != uint64(mi.Height) {
+			return false, 0, false
+		}
+		return bound == a.prim, uint64(mi.BaseTarget), true
+	}
 	// check if submission is late (height mismatch) if chain wasn't switched.
-	if round.Height != atomic.LoadUint64(&currentHeight) && currentPrimChain.Get() == lastPrimChain.Get() {
-		log.Println("DL out-dated:", round.Height, round.AccountID, round.Nonce, "X"+strconv.FormatUint(round.Deadline, 10))
-		return wrongHeight
+	if round.Height != atomic.LoadUint64(&a.currentHeight) && a.currentPrimChain.Get() == a.lastPrimChain.Get() {
+		return false, 0, false
 	}
 
 	// check if submission belong to previous block.
-	if round.Height != atomic.LoadUint64(&currentHeight) && round.Height != atomic.LoadUint64(&lastHeight) {
-		log.Println("DL out-dated:", round.Height, round.AccountID, round.Nonce, "X"+strconv.FormatUint(round.Deadline, 10))
-		return wrongHeight
+	if round.Height != atomic.LoadUint64(&a.currentHeight) && round.Height != atomic.LoadUint64(&a.lastHeight) {
+		return false, 0, false
 	}
 
+	if round.Height == atomic.LoadUint64(&a.currentHeight) {
+		return a.currentPrimChain.Get(), atomic.LoadUint64(&a.currentBaseTarget), true
+	}
+	return a.lastPrimChain.Get(), atomic.LoadUint64(&a.lastBaseTarget), true
+}
+
+func (a *Aggregator) tryUpdateRound(ctx *fasthttp.RequestCtx, src minerSource, round *minerRound, primChain bool, baseTarget uint64, deadline uint64) int {
+	accountID := round.AccountID
+	ip := src.submitKey()
+
 	// you lie I lie
-	_, exists := liarsCache.Get(ip)
+	_, exists := a.liars.Get(ip)
 	if exists {
 		return notUpdated
 	}
 
-	// load relevant data
-	var primChain = true
-	var baseTarget uint64 = 1
-	if round.Height == atomic.LoadUint64(&currentHeight) {
-		primChain = currentPrimChain.Get()
-		baseTarget = atomic.LoadUint64(&currentBaseTarget)
-	} else {
-		primChain = lastPrimChain.Get()
-		baseTarget = atomic.LoadUint64(&lastBaseTarget)
-	}
-	deadline := round.Deadline
-	if !round.Adjusted {
-		deadline /= baseTarget
+	// account filter
+	if (primChain && !a.prim.accounts.permits(accountID)) || (!primChain && !a.sec.accounts.permits(accountID)) {
+		logSubmit.Warn("DL not allowed", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
+		return accountNotAllowed
 	}
 
 	// deadlines filter
-	if (primChain && (deadline > primTDL)) || (!primChain && (deadline > secTDL)) {
-		log.Println("DL filtered:", round.Height, round.AccountID, round.Nonce, deadline)
+	if (primChain && (deadline > a.prim.cfg.TargetDeadline)) || (!primChain && (deadline > a.sec.cfg.TargetDeadline)) {
+		logSubmit.Debug("DL filtered", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 		return notUpdated
 	}
-	if (primChain && (deadline > atomic.LoadUint64(&primBest)) && primaryIgnoreWorseDeadlines) || (!primChain && (deadline > atomic.LoadUint64(&secBest) && secondaryIgnoreWorseDeadlines)) {
-		log.Println("DL discarded:", round.Height, round.AccountID, round.Nonce, deadline)
+	if (primChain && (deadline > atomic.LoadUint64(&a.prim.best)) && a.prim.cfg.IgnoreWorseDeadlines) || (!primChain && (deadline > atomic.LoadUint64(&a.sec.best) && a.sec.cfg.IgnoreWorseDeadlines)) {
+		logSubmit.Debug("DL discarded", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 		return notUpdated
 	}
 
 	var ipDataV interface{}
 
 	if primChain {
-		ipDataV, exists = primc.Get(ip)
+		ipDataV, exists = a.prim.submitted.Get(ip)
 	} else {
-		ipDataV, exists = secc.Get(ip)
+		ipDataV, exists = a.sec.submitted.Get(ip)
 	}
 
 	if !exists {
-		err := proxySubmitRound(w, r, ip, round, primChain, baseTarget)
+		err := a.proxySubmitRound(ctx, ip, src, round, primChain, baseTarget)
 		if err != nil {
 			return remoteErr
 		}
 		if primChain {
-			primc.SetDefault(ip, &ipData{
+			a.prim.submitted.SetDefault(ip, &ipData{
 				accountIDtoRound: map[uint64]*minerRound{
 					accountID: round,
 				},
 			})
 		} else {
-			secc.SetDefault(ip, &ipData{
+			a.sec.submitted.SetDefault(ip, &ipData{
 				accountIDtoRound: map[uint64]*minerRound{
 					accountID: round,
 				},
 			})
 		}
 		if primChain {
-			atomic.StoreUint64(&primBest, deadline)
+			atomic.StoreUint64(&a.prim.best, deadline)
+			a.prim.round.submitted(round.Height, accountID, deadline)
+			a.prim.forks.submitted(round, deadline)
 		} else {
-			atomic.StoreUint64(&secBest, deadline)
+			atomic.StoreUint64(&a.sec.best, deadline)
+			a.sec.round.submitted(round.Height, accountID, deadline)
+			a.sec.forks.submitted(round, deadline)
 		}
-		log.Println("DL response:", round.Height, round.AccountID, round.Nonce, deadline)
+		logSubmit.Info("DL response", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 		return updated
 	}
 	ipData := ipDataV.(*ipData)
@@ -207,14 +485,14 @@ func tryUpdateRound(w *http.ResponseWriter, r *http.Request, ip string, round *m
 	existingRound, exists := ipData.accountIDtoRound[accountID]
 	if !exists {
 		minerCount := len(ipData.accountIDtoRound)
-		if minerCount == minersPerIP {
+		if minerCount == a.cfg.MinersPerIP {
 			for _, otherRound := range ipData.accountIDtoRound {
 				if otherRound.Height < round.Height {
 					delete(ipData.accountIDtoRound, otherRound.AccountID)
 					goto update
 				}
 			}
-			log.Println("DL rejected:", round.Height, round.AccountID, round.Nonce, deadline)
+			logSubmit.Warn("DL rejected", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 			return exceededMinersPerIP
 		}
 	} else {
@@ -224,49 +502,53 @@ func tryUpdateRound(w *http.ResponseWriter, r *http.Request, ip string, round *m
 		}
 		if existingRound.Height > round.Height || existingRound.Height == round.Height &&
 			existingDeadline < deadline {
-			log.Println("DL ignored:", round.Height, round.AccountID, round.Nonce, deadline)
+			logSubmit.Debug("DL ignored", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 			return notUpdated
 		}
 	}
 update:
-	if err := proxySubmitRound(w, r, ip, round, primChain, baseTarget); err != nil {
+	if err := a.proxySubmitRound(ctx, ip, src, round, primChain, baseTarget); err != nil {
 		return remoteErr
 	}
 	ipData.accountIDtoRound[accountID] = round
 	if primChain {
-		atomic.StoreUint64(&primBest, deadline)
+		atomic.StoreUint64(&a.prim.best, deadline)
+		a.prim.round.submitted(round.Height, accountID, deadline)
+		a.prim.forks.submitted(round, deadline)
 	} else {
-		atomic.StoreUint64(&secBest, deadline)
+		atomic.StoreUint64(&a.sec.best, deadline)
+		a.sec.round.submitted(round.Height, accountID, deadline)
+		a.sec.forks.submitted(round, deadline)
 	}
-	log.Println("DL response:", round.Height, round.AccountID, round.Nonce, deadline)
+	logSubmit.Info("DL response", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "deadline", deadline)
 	return updated
 }
 
-func parseRound(r *http.Request) (*minerRound, error) {
+func parseRound(ctx *fasthttp.RequestCtx) (*minerRound, error) {
 	adjusted := false
-	deadline, err := strconv.ParseUint((*r).FormValue("deadline"), 10, 64)
+	deadline, err := strconv.ParseUint(string(ctx.FormValue("deadline")), 10, 64)
 	if err != nil {
 		// inefficient mining software detected :p
-		deadline, err = strconv.ParseUint((*r).Header.Get("X-Deadline"), 10, 64)
+		deadline, err = strconv.ParseUint(string(ctx.Request.Header.Peek("X-Deadline")), 10, 64)
 		if err != nil {
 			return nil, errSubmissionWrongFormatDeadline
 		}
 		adjusted = true
 	}
-	nonce, err := strconv.ParseUint((*r).FormValue("nonce"), 10, 64)
+	nonce, err := strconv.ParseUint(string(ctx.FormValue("nonce")), 10, 64)
 	if err != nil {
 		return nil, errSubmissionWrongFormatNonce
 	}
-	height, err := strconv.ParseUint((*r).FormValue("blockheight"), 10, 64)
+	height, err := strconv.ParseUint(string(ctx.FormValue("blockheight")), 10, 64)
 	if err != nil {
 		return nil, errSubmissionWrongFormatBlockHeight
 	}
-	accountID, err := strconv.ParseUint((*r).FormValue("accountId"), 10, 64)
+	accountID, err := strconv.ParseUint(string(ctx.FormValue("accountId")), 10, 64)
 	if err != nil {
 		return nil, errSubmissionWrongFormatAccountID
 	}
 
-	passphrase := (*r).FormValue("secretPhrase")
+	passphrase := string(ctx.FormValue("secretPhrase"))
 
 	return &minerRound{
 		Deadline:   deadline,
@@ -278,31 +560,27 @@ func parseRound(r *http.Request) (*minerRound, error) {
 	}, nil
 }
 
-func proxySubmitRound(w *http.ResponseWriter, r *http.Request, ip string, round *minerRound, primary bool, baseTarget uint64) error {
+func (a *Aggregator) proxySubmitRound(ctx *fasthttp.RequestCtx, ip string, src minerSource, round *minerRound, primary bool, baseTarget uint64) error {
 	// websocket api handling
-	if (primary && primaryws) || (!primary && secondaryws) {
+	if (primary && a.prim.ws) || (!primary && a.sec.ws) {
 		// fire submission
-		websocketClient.submitNonce(round.AccountID, round.Height, round.Nonce, round.Deadline)
-		log.Println("DL fired:", round.Height, round.AccountID, round.Nonce, round.Deadline)
+		a.websocket.submitNonce(round.AccountID, round.Height, round.Nonce, round.Deadline)
+		logSubmit.Info("DL fired", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "rawDeadline", round.Deadline)
 		// fake answer
-		var baseTarget = atomic.LoadUint64(&currentBaseTarget)
-		if round.Height != atomic.LoadUint64(&currentHeight) {
-			baseTarget = atomic.LoadUint64(&lastBaseTarget)
-		}
 		deadline := round.Deadline
 		if !round.Adjusted {
 			deadline /= baseTarget
 		}
-		(*w).Write([]byte(fmt.Sprintf("{\"deadline\":%d,\"result\":\"success\"}", deadline)))
+		ctx.Write([]byte(fmt.Sprintf("{\"deadline\":%d,\"result\":\"success\"}", deadline)))
 		return nil
 	}
 
 	// passphrase overwrites
-	if primary && primaryPassphrase != "" {
-		round.Passphrase = primaryPassphrase
+	if primary && a.prim.cfg.Passphrase != "" {
+		round.Passphrase = a.prim.cfg.Passphrase
 	}
-	if !primary && secondaryPassphrase != "" {
-		round.Passphrase = secondaryPassphrase
+	if !primary && a.sec.cfg.Passphrase != "" {
+		round.Passphrase = a.sec.cfg.Passphrase
 	}
 
 	v, _ := query.Values(round)
@@ -320,52 +598,50 @@ func proxySubmitRound(w *http.ResponseWriter, r *http.Request, ip string, round
 
 	v.Del("Adjusted")
 
-	var submitURL string
-	if primary {
-		submitURL = primarySubmitURL
-	} else {
-		submitURL = secondarySubmitURL
+	u := a.prim.upstream
+	if !primary {
+		u = a.sec.upstream
 	}
 
 	req := fasthttp.AcquireRequest()
-	req.URI().Update(submitURL + "/burst?requestType=submitNonce&" + v.Encode())
+	defer fasthttp.ReleaseRequest(req)
+	req.URI().Update(u.url + "/burst?requestType=submitNonce&" + v.Encode())
 
-	var miner string
-	if ua := r.Header.Get("User-Agent"); ua == "" {
-		miner = r.Header.Get("X-Miner")
-	} else {
-		miner = ua
-	}
+	miner := string(src.software)
 
-	req.Header.Set("User-Agent", "Aggregator/"+version+"/"+miner)
-	req.Header.Set("X-Miner", "Aggregator/"+version+"/"+miner)
-	req.Header.Set("X-MinerAlias", minerAlias)
-	req.Header.Set("X-Capacity", strconv.FormatInt(TotalCapacity(), 10))
+	req.Header.Set("User-Agent", "Aggregator/"+Version+"/"+miner)
+	req.Header.Set("X-Miner", "Aggregator/"+Version+"/"+miner)
+	req.Header.Set("X-MinerAlias", a.cfg.MinerAlias)
+	req.Header.Set("X-Capacity", strconv.FormatInt(u.reportedCapacity(round.AccountID), 10))
+	if u.relayName != "" {
+		u.setRelayHeaders(req)
+		req.Header.Set("X-Relay-Miner-IP", src.ip.String())
+		req.Header.Set("X-Relay-Miner-Name", string(src.name))
+		req.Header.Set("X-Relay-Miner-Software", string(src.software))
+	}
 	if primary {
-		req.Header.Set("X-Account", primaryAccountKey)
+		req.Header.Set("X-Account", a.prim.cfg.AccountKey)
 	} else {
-		req.Header.Set("X-Account", secondaryAccountKey)
+		req.Header.Set("X-Account", a.sec.cfg.AccountKey)
 	}
 
 	// x-forwarded-for
-	if (primary && primaryIPForwarding) || (!primary && secondaryIPForwarding) {
-		ip, _, err := net.SplitHostPort(ip)
-		if err == nil {
-			req.Header.Set("X-Forwarded-For", ip)
-		}
+	if (primary && a.prim.cfg.IPForwarding) || (!primary && a.sec.cfg.IPForwarding) {
+		req.Header.Set("X-Forwarded-For", src.ip.String())
 	}
 
 	req.Header.SetMethodBytes([]byte("POST"))
 	resp := fasthttp.AcquireResponse()
-	err := client.Do(req, resp)
+	defer fasthttp.ReleaseResponse(resp)
+	err := u.do(req, resp)
 
 	if err != nil {
-		(*w).Write(formatJSONError(3, "error reaching pool or wallet"))
+		ctx.Write(formatJSONError(3, "error reaching pool or wallet"))
 		return err
 	}
 
 	// lie detector
-	if lieDetector {
+	if a.cfg.LieDetector {
 		var mi submitResponse
 		if err := jsonx.Unmarshal(resp.Body(), &mi); err == nil {
 			deadline := round.Deadline
@@ -374,422 +650,279 @@ func proxySubmitRound(w *http.ResponseWriter, r *http.Request, ip string, round
 			}
 			if uint64(mi.Deadline) != deadline {
 				var liar = true
-				liarsCache.SetDefault(ip, &liar)
-				log.Println("Liar detected:", round.Height, ip, mi.Deadline, deadline)
+				a.liars.SetDefault(ip, &liar)
+				logSubmit.Warn("Liar detected", "height", round.Height, "ip", ip, "poolDeadline", mi.Deadline, "deadline", deadline)
+				a.notifications.notify(eventLiarDetected, map[string]interface{}{"ip": ip, "height": round.Height, "accountId": round.AccountID},
+					"liar detected at %s, height %d, claimed deadline %d, pool deadline %d", ip, round.Height, deadline, mi.Deadline)
 			}
 		}
 	}
 
-	(*w).Write(resp.Body())
+	ctx.Write(resp.Body())
 	return nil
 }
 
-func refreshMiningInfo() error {
-	// primary chain
-	var mi miningInfo
-	var errchain1 error
-	if primaryws {
-		if available.Get() {
-			mi = *currentMiningInfo.Load().(*miningInfo)
-		} else {
-			// initial mining info missing
-			errchain1 = fmt.Errorf("primary chain: initial mining info missing")
-		}
-	} else {
-		req := fasthttp.AcquireRequest()
-		req.URI().Update(primarySubmitURL + "/burst?requestType=getMiningInfo")
-		req.Header.Set("User-Agent", "Aggregator/"+version)
-		req.Header.Set("X-Miner", "Aggregator/"+version)
-		req.Header.Set("X-Capacity", strconv.FormatInt(TotalCapacity(), 10))
-		req.Header.SetMethodBytes([]byte("GET"))
-		resp := fasthttp.AcquireResponse()
-		err1 := client.Do(req, resp)
-		errchain1 = err1
-		if errchain1 == nil {
-			if err := jsonx.Unmarshal(resp.Body(), &mi); err != nil {
-				return err
-			}
-		}
-	}
-
-	var curPrimMi *miningInfo
-	if curPrimMiV := curPrimaryMiningInfo.Load(); curPrimMiV != nil {
+// refreshMiningInfo fetches the mining info of both chains. A new primary block interrupts the secondary chain,
+// the secondary chain is only mined while the primary one is not scanning.
+func (a *Aggregator) refreshMiningInfo() error {
+	var curPrimMi, curSecMi *miningInfo
+	if curPrimMiV := a.prim.miningInfo.Load(); curPrimMiV != nil {
 		curPrimMi = curPrimMiV.(*miningInfo)
 	}
-
-	var curSecMi *miningInfo
-	if curSecMiV := curSecondaryMiningInfo.Load(); curSecMiV != nil {
+	if curSecMiV := a.sec.miningInfo.Load(); curSecMiV != nil {
 		curSecMi = curSecMiV.(*miningInfo)
 	}
 
-	var lastPrimaryStart = time.Time{}
-	if curPrimMi != nil {
-		lastPrimaryStart = curPrimMi.StartTime
-	}
-
-	var lastSecondaryStart = time.Time{}
-	if curSecMi != nil {
-		lastSecondaryStart = curSecMi.StartTime
-	}
+	// primary chain
+	var mi miningInfo
+	errchain1 := a.fetchMiningInfo(a.prim, &mi)
+	a.prim.health.fetched(errchain1)
 	if errchain1 == nil {
-		switch {
-		case curPrimMi == nil || curPrimMi.Height < mi.Height:
-			log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-			if displayMiners {
-				DisplayMiners()
-			}
-			mi.bytes, _ = json.Marshal(map[string]string{
-				"height":              fmt.Sprintf("%d", mi.Height),
-				"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-				"generationSignature": mi.GenSig})
-			mi.StartTime = time.Now()
-			curPrimaryMiningInfo.Store(&mi)
-			if !currentPrimChain.Get() {
-				atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-				atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-				lastPrimChain.Set(false)
-			}
-			atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-			atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-			currentPrimChain.Set(true)
-			atomic.StoreUint64(&primBest, ^uint64(0))
-			// reschedule secondary chain on interrupt
-			if int64(time.Now().Sub(lastSecondaryStart).Seconds()) < scanTime {
-				reset := miningInfo{0, 0, 0, "", []byte{0}, time.Time{}}
-				curSecondaryMiningInfo.Store(&reset)
-			}
-			return nil
-		case curPrimMi.Height > mi.Height: // fork handling
-			log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-			if displayMiners {
-				DisplayMiners()
-			}
-			mi.bytes, _ = json.Marshal(map[string]string{
-				"height":              fmt.Sprintf("%d", mi.Height),
-				"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-				"generationSignature": mi.GenSig})
-			mi.StartTime = time.Now()
-			curPrimaryMiningInfo.Store(&mi)
-			primc.Flush()
-			if !currentPrimChain.Get() {
-				atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-				atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-				lastPrimChain.Set(false)
-			}
-			atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-			atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-			currentPrimChain.Set(true)
-			atomic.StoreUint64(&primBest, ^uint64(0))
+		a.prim.health.update(&mi)
+		if event, prev := a.prim.forks.detect(&mi); event != blockUnchanged {
+			a.newBlock(a.prim, &mi, event, prev)
 			// reschedule secondary chain on interrupt
-			if int64(time.Now().Sub(lastSecondaryStart).Seconds()) < scanTime {
+			if curSecMi != nil && time.Since(curSecMi.StartTime) < a.cfg.ScanTime {
 				reset := miningInfo{0, 0, 0, "", []byte{0}, time.Time{}}
-				curSecondaryMiningInfo.Store(&reset)
-			}
-			return nil
-		case curPrimMi.BaseTarget != mi.BaseTarget: // fork handling
-			log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-			if displayMiners {
-				DisplayMiners()
-			}
-			mi.bytes, _ = json.Marshal(map[string]string{
-				"height":              fmt.Sprintf("%d", mi.Height),
-				"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-				"generationSignature": mi.GenSig})
-			mi.StartTime = time.Now()
-			curPrimaryMiningInfo.Store(&mi)
-			primc.Flush()
-			if !currentPrimChain.Get() {
-				atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-				atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-				lastPrimChain.Set(false)
-			}
-			atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-			atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-			currentPrimChain.Set(true)
-			atomic.StoreUint64(&primBest, ^uint64(0))
-			// reschedule secondary chain on interrupt
-			if int64(time.Now().Sub(lastSecondaryStart).Seconds()) < scanTime {
-				reset := miningInfo{0, 0, 0, "", []byte{0}, time.Time{}}
-				curSecondaryMiningInfo.Store(&reset)
+				a.sec.miningInfo.Store(&reset)
 			}
 			return nil
 		}
 	}
 
 	// single chain
-	if secondarySubmitURL == "" {
+	if a.cfg.Secondary.SubmitURL == "" {
 		return nil
 	}
 	// skip secondary if primary is scanning
-	if int64(time.Now().Sub(lastPrimaryStart).Seconds()) < scanTime {
+	if curPrimMi != nil && time.Since(curPrimMi.StartTime) < a.cfg.ScanTime {
 		return nil
 	}
 
 	// secondary chain
-	var errchain2 error
-	if secondaryws {
-		if available.Get() {
-			mi = *currentMiningInfo.Load().(*miningInfo)
-		} else {
-			// initial mining info missing
-			errchain2 = fmt.Errorf("secondary chain: initial mining info missing")
-			return errchain2
-		}
-	} else {
-		req := fasthttp.AcquireRequest()
-		req.URI().Update(secondarySubmitURL + "/burst?requestType=getMiningInfo")
-		req.Header.Set("User-Agent", "Aggregator/"+version)
-		req.Header.Set("X-Miner", "Aggregator/"+version)
-		req.Header.Set("X-Capacity", strconv.FormatInt(TotalCapacity(), 10))
-		req.Header.SetMethodBytes([]byte("GET"))
-		resp := fasthttp.AcquireResponse()
-		err2 := client.Do(req, resp)
-		errchain2 = err2
-		if errchain2 == nil {
-			if err := jsonx.Unmarshal(resp.Body(), &mi); err != nil {
-				return err
-			}
-		} else {
-			return errchain2
-		}
+	var secMi miningInfo
+	errchain2 := a.fetchMiningInfo(a.sec, &secMi)
+	a.sec.health.fetched(errchain2)
+	if errchain2 != nil {
+		return errchain2
+	}
+	a.sec.health.update(&secMi)
+	event, prev := a.sec.forks.detect(&secMi)
+	if event != blockUnchanged {
+		a.newBlock(a.sec, &secMi, event, prev)
+		return nil
+	}
+	if curSecMi != nil && curSecMi.Height == 0 && a.resume(a.sec) {
+		// the round was interrupted by a primary block, continue it
+		logChain.Info("Block resumed", "chain", a.sec.name, "height", secMi.Height)
 	}
+	return nil
+}
 
-	switch {
-	case curSecMi == nil || curSecMi.Height < mi.Height:
-		log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-		if displayMiners {
-			DisplayMiners()
-		}
-		mi.bytes, _ = json.Marshal(map[string]string{
-			"height":              fmt.Sprintf("%d", mi.Height),
-			"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-			"generationSignature": mi.GenSig})
-		mi.StartTime = time.Now()
-		curSecondaryMiningInfo.Store(&mi)
+// resume serves the latest block of c again with a new scan time and switches the miners to c,
+// false if c has no block yet
+func (a *Aggregator) resume(c *chain) bool {
+	latest, _ := c.latest.Load().(*miningInfo)
+	if latest == nil {
+		return false
+	}
+	resumed := *latest
+	resumed.StartTime = time.Now()
+	c.miningInfo.Store(&resumed)
+	a.switchTo(c, &resumed)
+	return true
+}
 
-		if currentPrimChain.Get() {
-			atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-			atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-			lastPrimChain.Set(true)
-		}
-		atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-		atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-		currentPrimChain.Set(false)
-		atomic.StoreUint64(&secBest, ^uint64(0))
-		return nil
-	case curSecMi.Height > mi.Height: // fork handling
-		log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-		if displayMiners {
-			DisplayMiners()
-		}
-		mi.bytes, _ = json.Marshal(map[string]string{
-			"height":              fmt.Sprintf("%d", mi.Height),
-			"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-			"generationSignature": mi.GenSig})
-		mi.StartTime = time.Now()
-		curSecondaryMiningInfo.Store(&mi)
-		secc.Flush()
-		if currentPrimChain.Get() {
-			atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-			atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-			lastPrimChain.Set(true)
-		}
-		atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-		atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-		currentPrimChain.Set(true)
-		atomic.StoreUint64(&secBest, ^uint64(0))
-		return nil
-	case curSecMi.BaseTarget != mi.BaseTarget: // fork handling
-		log.Println("New Block", mi.Height, mi.BaseTarget, mi.TargetDeadline, mi.GenSig)
-		if displayMiners {
-			DisplayMiners()
-		}
-		mi.bytes, _ = json.Marshal(map[string]string{
-			"height":              fmt.Sprintf("%d", mi.Height),
-			"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
-			"generationSignature": mi.GenSig})
-		mi.StartTime = time.Now()
-		curSecondaryMiningInfo.Store(&mi)
-		secc.Flush()
-		if currentPrimChain.Get() {
-			atomic.StoreUint64(&lastBaseTarget, atomic.LoadUint64(&currentBaseTarget))
-			atomic.StoreUint64(&lastHeight, atomic.LoadUint64(&currentHeight))
-			lastPrimChain.Set(true)
-		}
-		atomic.StoreUint64(&currentBaseTarget, uint64(mi.BaseTarget))
-		atomic.StoreUint64(&currentHeight, uint64(mi.Height))
-		currentPrimChain.Set(false)
-		atomic.StoreUint64(&secBest, ^uint64(0))
-		return nil
+// fetchMiningInfo gets the mining info of a chain from its upstream or the websocket api
+func (a *Aggregator) fetchMiningInfo(c *chain, mi *miningInfo) error {
+	if !c.ws {
+		return c.upstream.getMiningInfo(mi)
+	}
+	wsMi, ok := a.websocket.MiningInfo()
+	if !ok {
+		// initial mining info missing or websocket not subscribed
+		return fmt.Errorf("%s chain: websocket api %s, no mining info", c.name, a.websocket.State())
 	}
+	*mi = *wsMi
 	return nil
 }
 
-func requestHandler(w http.ResponseWriter, r *http.Request) {
-	ipport := r.RemoteAddr
-	ip, port, _ := net.SplitHostPort(ipport)
-	switch reqType := string(r.FormValue("requestType")); reqType {
+// newBlock serves the block of a chain detected as new, reorg, rollback or retarget. The submissions of a replaced
+// block are forgotten and the best deadline forwarded for a height that reappeared is submitted again.
+func (a *Aggregator) newBlock(c *chain, mi *miningInfo, event blockEvent, prev blockID) {
+	switch event {
+	case blockNew:
+		logChain.Info("New block", "chain", c.name, "height", mi.Height, "baseTarget", mi.BaseTarget, "targetDeadline", mi.TargetDeadline, "genSig", mi.GenSig)
+	case blockRetarget:
+		logChain.Info("Base target changed", "chain", c.name, "height", mi.Height, "baseTarget", mi.BaseTarget, "previousBaseTarget", prev.baseTarget)
+	default:
+		logChain.Warn("Chain reorg", "chain", c.name, "event", event, "height", mi.Height, "previousHeight", prev.height,
+			"baseTarget", mi.BaseTarget, "previousBaseTarget", prev.baseTarget, "genSig", mi.GenSig, "previousGenSig", prev.genSig,
+			"reorgs", c.forks.reorgCount())
+	}
+	if event != blockRetarget {
+		c.round.newBlock(uint64(mi.Height))
+		c.stats.newBlock(uint64(mi.Height))
+		if a.cfg.DisplayMiners {
+			a.DisplayMiners()
+		}
+	}
+	mi.bytes, _ = json.Marshal(map[string]string{
+		"height":              fmt.Sprintf("%d", mi.Height),
+		"baseTarget":          fmt.Sprintf("%d", mi.BaseTarget),
+		"generationSignature": mi.GenSig})
+	mi.StartTime = time.Now()
+	c.miningInfo.Store(mi)
+	c.latest.Store(mi)
+	if event.replaces() {
+		c.submitted.Flush()
+	}
+	a.switchTo(c, mi)
+	atomic.StoreUint64(&c.best, ^uint64(0))
+	if !event.replaces() {
+		return
+	}
+	// the upstream may take up to its read timeout, the refresh goes on meanwhile
+	if best, exists := c.forks.replaced(uint64(mi.Height)); exists {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.resubmit(c, best)
+		}()
+	}
+}
+
+// switchTo makes c the chain served to miners following the aggregator, the block of the other chain
+// stays valid for late submissions
+func (a *Aggregator) switchTo(c *chain, mi *miningInfo) {
+	primary := c == a.prim
+	if a.currentPrimChain.Get() != primary {
+		atomic.StoreUint64(&a.lastBaseTarget, atomic.LoadUint64(&a.currentBaseTarget))
+		atomic.StoreUint64(&a.lastHeight, atomic.LoadUint64(&a.currentHeight))
+		a.lastPrimChain.Set(!primary)
+	}
+	atomic.StoreUint64(&a.currentBaseTarget, uint64(mi.BaseTarget))
+	atomic.StoreUint64(&a.currentHeight, uint64(mi.Height))
+	a.currentPrimChain.Set(primary)
+}
+
+// requestHandler answers miners, getMiningInfo is the hot path and must not allocate for known miners.
+// Requests of relays are authenticated by relayHandler and answered for the miners behind them.
+func (a *Aggregator) requestHandler(ctx *fasthttp.RequestCtx, l *listener, r *relay) {
+	var identity *minerIdentity
+	if r == nil {
+		var err error
+		if identity, err = l.authenticate(ctx); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			ctx.Write(formatJSONError(5, err.Error()))
+			return
+		}
+	}
+	switch reqType := string(ctx.FormValue("requestType")); reqType {
 	case "getMiningInfo":
-		if currentPrimChain.Get() {
-			w.Write(curPrimaryMiningInfo.Load().(*miningInfo).bytes)
-		} else {
-			w.Write(curSecondaryMiningInfo.Load().(*miningInfo).bytes)
+		mi := a.servedMiningInfo(l.chain)
+		if mi == nil {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			ctx.Write(formatJSONError(8, errNoMiningInfo.Error()))
+			return
 		}
-		// log client
-		var miner string
-		if ua := r.Header.Get("User-Agent"); ua == "" {
-			miner = r.Header.Get("X-Miner")
-		} else {
-			miner = ua
+		ctx.Write(mi.bytes)
+		if r != nil {
+			// relays announce their miners
+			return
 		}
-		size, _ := strconv.ParseInt(r.Header.Get("X-Capacity"), 10, 64)
-		UpdateClient(ip, port, miner, size)
-		if primaryws || secondaryws {
-			websocketClient.UpdateSize(TotalCapacity())
+		// log client
+		size, err := fasthttp.ParseUint(ctx.Request.Header.Peek("X-Capacity"))
+		if err != nil {
+			// missing or invalid
+			size = 0
 		}
+		// miners are accounted by the client ip, resolved behind trusted proxies
+		a.miners.update(minerSource{ip: a.limiter.remoteIP(ctx), name: clientName(ctx, identity), software: minerSoftware(ctx)}, int64(size))
 
 	case "submitNonce":
-		round, err := parseRound(r)
+		src := minerSource{ip: a.limiter.remoteIP(ctx), name: clientName(ctx, identity), software: minerSoftware(ctx)}
+		if r != nil {
+			src = r.source(ctx)
+			atomic.AddUint64(&r.submissions, 1)
+		}
+		round, err := parseRound(ctx)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(formatJSONError(1, err.Error()))
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.Write(formatJSONError(1, err.Error()))
+			return
+		}
+		if !identity.allowed(round.AccountID) {
+			logSubmit.Warn("DL unauthorized", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "miner", identity.name)
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.Write(formatJSONError(6, errAccountNotAllowed.Error()))
+			return
+		}
+		primChain, baseTarget, ok := a.roundChain(round, l.chain)
+		if !ok {
+			a.lateChain(round, l.chain).stats.late(src, round.AccountID)
+			logSubmit.Debug("DL out-dated", "height", round.Height, "accountId", round.AccountID, "nonce", round.Nonce, "rawDeadline", round.Deadline)
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.Write(formatJSONError(1005, "Submitted on wrong height"))
 			return
 		}
-		switch res := tryUpdateRound(&w, r, ip, round); res {
+		deadline := round.Deadline
+		if !round.Adjusted {
+			deadline /= baseTarget
+		}
+		res := a.tryUpdateRound(ctx, src, round, primChain, baseTarget, deadline)
+		// only accepted deadlines are recorded, deadlines of liars are made up
+		if _, liar := a.liars.Get(src.submitKey()); !liar && (res == updated || res == notUpdated) {
+			a.miners.submission(src, round, primChain, baseTarget, deadline)
+			c := a.prim
+			if !primChain {
+				c = a.sec
+			}
+			c.stats.submitted(src, round.AccountID, round.Height, baseTarget, deadline)
+		}
+		switch res {
 		case updated:
 		case notUpdated:
-			var baseTarget = atomic.LoadUint64(&currentBaseTarget)
-			if round.Height != atomic.LoadUint64(&currentHeight) {
-				baseTarget = atomic.LoadUint64(&lastBaseTarget)
-			}
-			deadline := round.Deadline
-			if !round.Adjusted {
-				deadline /= baseTarget
-			}
-			w.Write([]byte(fmt.Sprintf("{\"deadline\":%d,\"result\":\"success\"}", deadline)))
-		case wrongHeight:
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(formatJSONError(1005, "Submitted on wrong height"))
+			ctx.Write([]byte(fmt.Sprintf("{\"deadline\":%d,\"result\":\"success\"}", deadline)))
 		case exceededMinersPerIP:
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write(formatJSONError(2, errTooManySubmissionsDifferentMiners.Error()))
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.Write(formatJSONError(2, errTooManySubmissionsDifferentMiners.Error()))
+		case accountNotAllowed:
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.Write(formatJSONError(9, errAccountNotAllowedOnChain.Error()))
 		}
+	case "getStats":
+		if !l.stats {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.Write(formatJSONError(4, errUnknownRequestType.Error()))
+			return
+		}
+		a.writeStats(ctx)
+	case "announceRelay":
+		if r == nil {
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			ctx.Write(formatJSONError(5, errUnknownRelay.Error()))
+			return
+		}
+		a.announced(ctx, r)
 	default:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(formatJSONError(4, errUnknownRequestType.Error()))
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(formatJSONError(4, errUnknownRequestType.Error()))
 	}
 }
 
-func main() {
-	log.Println("Aggregator v." + version)
-
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
-	if err != nil {
-		panic(fmt.Errorf("fatal error config file: %s", err))
-	}
-
-	client = &fasthttp.Client{NoDefaultUserAgentHeader: true}
-	client.MaxIdleConnDuration = 0 * time.Millisecond
-
-	listenAddr = viper.GetString("listenAddr")
-	displayMiners = viper.GetBool("displayMiners")
-	log.Println("Proxy address:", listenAddr)
-	minersPerIP = viper.GetInt("minersPerIP")
-	primarySubmitURL = viper.GetString("primarySubmitURL")
-	primaryPassphrase = viper.GetString("primaryPassphrase")
-	primaryIPForwarding = viper.GetBool("primaryIpForwarding")
-	primaryIgnoreWorseDeadlines = viper.GetBool("primaryIgnoreWorseDeadlines")
-	primaryAccountKey = viper.GetString("primaryAccountKey")
-	primTDL = uint64(viper.GetInt64("primaryTargetDeadline"))
-	secondarySubmitURL = viper.GetString("secondarySubmitURL")
-	secondaryPassphrase = viper.GetString("secondaryPassphrase")
-	secondaryIPForwarding = viper.GetBool("secondaryIpForwarding")
-	secondaryIgnoreWorseDeadlines = viper.GetBool("secondaryIgnoreWorseDeadlines")
-	secondaryAccountKey = viper.GetString("secondaryAccountKey")
-	secTDL = uint64(viper.GetInt64("secondaryTargetDeadline"))
-	fileLogging = viper.GetBool("fileLogging")
-
-	scanTime = viper.GetInt64("scanTime")
-	rateLimit = viper.GetInt("rateLimit")
-	burstRate = viper.GetInt("burstRate")
-	lieDetector = viper.GetBool("lieDetector")
-	log.Println("Primary chain:", primarySubmitURL)
-	log.Println("Secondary chain:", secondarySubmitURL)
-	log.Println("Rate Limiter:", "limit="+strconv.Itoa(rateLimit), "per second, burstrate="+strconv.Itoa(burstRate))
-	minerName = viper.GetString("minerName")
-	minerAlias = viper.GetString("minerAlias")
-
-	// todo check exactly one url is wss
-	primaryws = strings.HasPrefix(primarySubmitURL, "wss")
-	secondaryws = strings.HasPrefix(secondarySubmitURL, "wss")
-
-	if primaryws && secondaryws {
-		panic("can only have a single websocket upstream")
-	}
-
-	// launch api
-	if primaryws {
-		websocketClient = newWebsocketAPI(primarySubmitURL, primaryAccountKey, minerName, 0)
-		websocketClient.Connect()
-	}
-
-	if secondaryws {
-		websocketClient = newWebsocketAPI(secondarySubmitURL, secondaryAccountKey, minerName, 0)
-		websocketClient.Connect()
-	}
-	// amend submit & getMiningInfo
-
-	if fileLogging {
-		logFile, err := os.OpenFile("log.txt", os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-		if err != nil {
-			panic(err)
-		}
-
-		mw := io.MultiWriter(os.Stdout, logFile)
-		log.SetOutput(mw)
-	}
-
-	clients = cache.New(minerCacheExpiration, minerCacheExpiration)
-
-	if err := refreshMiningInfo(); err != nil {
-		log.Fatalln("get initial mining info: ", err)
-	}
-	go func() {
-		t := time.NewTicker(1 * time.Second)
-		for {
-			for range t.C {
-				_ = refreshMiningInfo()
-			}
+// servedMiningInfo returns the mining info for miners of a listener bound to c, nil before the first block
+func (a *Aggregator) servedMiningInfo(c *chain) *miningInfo {
+	if c == nil {
+		c = a.sec
+		if a.currentPrimChain.Get() {
+			c = a.prim
 		}
-	}()
-
-	primc = cache.New(defaultCacheExpiration, defaultCacheExpiration)
-	secc = cache.New(defaultCacheExpiration, defaultCacheExpiration)
-	liarsCache = cache.New(defaultCacheExpiration, defaultCacheExpiration)
-
-	store, err := memstore.New(65536)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	quota := throttled.RateQuota{MaxRate: throttled.PerSec(rateLimit), MaxBurst: burstRate}
-	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	httpRateLimiter := throttled.HTTPRateLimiter{
-		RateLimiter: rateLimiter,
-		VaryBy:      &throttled.VaryBy{Path: true},
-	}
-
-	h := http.HandlerFunc(requestHandler)
-	err = fasthttp.ListenAndServe(listenAddr, NewFastHTTPHandler(httpRateLimiter.RateLimit(h)))
-	if err != nil {
-		log.Fatalf("listen and serve: %s", err)
+		mi, _ := c.miningInfo.Load().(*miningInfo)
+		return mi
 	}
+	mi, _ := c.latest.Load().(*miningInfo)
+	return mi
 }
 
 func formatJSONError(errorCode int64, errorMsg string) []uint8 {
@@ -0,0 +1,388 @@
+package aggregator
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// setupBenchmark prepares a single chain proxy forwarding to an in memory pool
+func setupBenchmark(b testing.TB) *Aggregator {
+	SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+
+	ln := fasthttputil.NewInmemoryListener()
+	pool := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		ctx.WriteString("{\"deadline\":1000,\"result\":\"success\"}")
+	}}
+	go pool.Serve(ln)
+	b.Cleanup(func() {
+		ln.Close()
+		SetLogHandler(slog.NewTextHandler(os.Stderr, nil))
+	})
+	a, err := New(Config{
+		Primary:     ChainConfig{SubmitURL: "http://pool", TargetDeadline: ^uint64(0)},
+		MinersPerIP: 100,
+		RateLimit:   1000000,
+		BurstRate:   1000000,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	a.prim.upstream.client.Dial = func(addr string) (net.Conn, error) { return ln.Dial() }
+
+	mi := &miningInfo{Height: 1000, BaseTarget: 50000, GenSig: "abcd"}
+	mi.bytes = []byte("{\"baseTarget\":\"50000\",\"generationSignature\":\"abcd\",\"height\":\"1000\"}")
+	a.prim.miningInfo.Store(mi)
+	a.currentPrimChain.Set(true)
+	a.lastPrimChain.Set(true)
+	a.currentHeight = 1000
+	a.currentBaseTarget = 50000
+	return a
+}
+
+func newBenchmarkCtx(uri string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	req.Header.Set("User-Agent", "scavenger/1.7.8")
+	req.Header.Set("X-Capacity", "1024")
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 50000}, nil)
+	return &ctx
+}
+
+func BenchmarkGetMiningInfo(b *testing.B) {
+	handler := setupBenchmark(b).Handler()
+	ctx := newBenchmarkCtx("/burst?requestType=getMiningInfo")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.Response.Reset()
+		handler(ctx)
+	}
+}
+
+func BenchmarkSubmitNonce(b *testing.B) {
+	handler := setupBenchmark(b).Handler()
+	ctx := newBenchmarkCtx("/burst?requestType=submitNonce&accountId=1234&nonce=5678&blockheight=1000&deadline=50000000")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.Response.Reset()
+		handler(ctx)
+	}
+}
+
+// TestCapacityEstimator feeds best deadlines of a known capacity on both chains, the rounds of the
+// chains share heights and must not be mixed up
+func TestCapacityEstimator(t *testing.T) {
+	const capacityGiB = 1000
+	const baseTarget = 100000000
+	rng := rand.New(rand.NewSource(1))
+	// the best normalized hit of N nonces is exponentially distributed with rate N
+	bestDeadline := func() uint64 {
+		x := rng.ExpFloat64() / (capacityGiB * noncesPerGiB)
+		return uint64(x * math.Exp2(64) / baseTarget)
+	}
+	var e capacityEstimator
+	for height := uint64(1000); height < 1400; height++ {
+		e.add(true, height, baseTarget, bestDeadline())
+		e.add(false, height, baseTarget, bestDeadline())
+	}
+	estimate, rounds := e.estimate()
+	if rounds != estimationRounds {
+		t.Fatalf("estimate based on %d rounds, want %d", rounds, estimationRounds)
+	}
+	if math.Abs(float64(estimate)-capacityGiB) > 0.15*capacityGiB {
+		t.Fatalf("estimated %d GiB, want %d GiB within 15%%", estimate, capacityGiB)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.write(dir, 2)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.SerialNumber.Int64()
+	}
+	if s := serial(); s != 2 {
+		t.Fatalf("serial 2 expected, got %d", s)
+	}
+
+	// a renewed certificate is served after the next check
+	ca.write(dir, 3)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := serial(); s != 2 {
+		t.Fatalf("files checked again within %s, got serial %d", certCheckInterval, s)
+	}
+	cr.lastCheck = time.Time{}
+	if s := serial(); s != 3 {
+		t.Fatalf("reloaded serial 3 expected, got %d", s)
+	}
+
+	// a broken certificate keeps the old one
+	if err := os.WriteFile(certFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	cr.lastCheck = time.Time{}
+	if s := serial(); s != 3 {
+		t.Fatalf("serial 3 kept expected, got %d", s)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.write(dir, 2)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	handshakes := make(chan error)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	certPEM, keyPEM := ca.issue(3)
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{{"without certificate", nil, false}, {"with certificate", []tls.Certificate{clientCert}, true}} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, Certificates: test.certs})
+		// with tls 1.3 the client finishes its handshake before the server checks the certificate
+		if serverErr := <-handshakes; err == nil {
+			err = serverErr
+			conn.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Fatalf("%s: accepted %t expected, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	rl, err := newRateLimiter(Config{RateLimit: 1, TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remote, forwarded, client string
+	}{
+		{"192.168.1.10", "1.2.3.4", "192.168.1.10"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1", "5.6.7.8, 1.2.3.4,10.0.0.2", "1.2.3.4"},
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1", "1.2.3.4, garbage, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1", "2001:db8::1", "2001:db8::1"},
+	} {
+		if ip := rl.clientIP(net.ParseIP(test.remote), []byte(test.forwarded)); ip.String() != test.client {
+			t.Fatalf("%s behind %q: %s expected, got %s", test.remote, test.forwarded, test.client, ip)
+		}
+	}
+}
+
+func TestUpstreamProxies(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	for _, test := range []struct {
+		scheme string
+		user   string
+		target string // address dialed
+		sent   string // address requested from the proxy
+		byName bool
+	}{
+		{"http", "", "localhost:" + port, "localhost:" + port, false},
+		{"http", "user:secret", "127.0.0.1:" + port, "127.0.0.1:" + port, false},
+		{"socks5", "", "127.0.0.1:" + port, "127.0.0.1:" + port, false},
+		{"socks5", "user:secret", "localhost:" + port, "127.0.0.1:" + port, false},
+		{"socks5h", "", "localhost:" + port, "localhost:" + port, true},
+	} {
+		name := test.scheme + " " + test.target
+		proxy := newFakeProxy(t, test.scheme != "http")
+		userinfo := ""
+		if test.user != "" {
+			userinfo = test.user + "@"
+		}
+		dial, err := newProxyDial(test.scheme+"://"+userinfo+proxy.addr(), &net.Dialer{Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		conn, err := dial("tcp", test.target)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		buf := make([]byte, 4)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("%s: echo through the tunnel expected, got %q, %v", name, buf, err)
+		}
+		conn.Close()
+		if sent, byName, auth := proxy.requested(); sent != test.sent || byName != test.byName || auth != test.user {
+			t.Fatalf("%s: %s (by name %t) with %q expected, proxy got %s (by name %t) with %q",
+				name, test.sent, test.byName, test.user, sent, byName, auth)
+		}
+
+		// tunnels rejected by the proxy fail the dial
+		proxy.reject.Store(true)
+		if conn, err := dial("tcp", test.target); err == nil {
+			conn.Close()
+			t.Fatalf("%s: rejected tunnel must fail", name)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	var mu sync.Mutex
+	received := make(map[string][]map[string]interface{}) // path -> payloads
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" ||
+			json.NewDecoder(r.Body).Decode(&payload) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], payload)
+		mu.Unlock()
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	payloads := func(path string) []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return received[path]
+	}
+
+	n, err := newNotifier([]Webhook{
+		{URL: srv.URL + "/failing"},
+		{URL: srv.URL + "/json"},
+		{URL: srv.URL + "/telegram", Format: "telegram", ChatID: "42", Events: []string{eventUpstreamDown}},
+		{URL: srv.URL + "/discord", Format: "discord"},
+	}, "farm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// events beyond the queue size are dropped until the queue is drained
+	for i := 0; i < notificationQueueSize+10; i++ {
+		n.notify(eventMinerOffline, map[string]int{"i": i}, "miner %d offline", i)
+	}
+	if len(n.queue) != notificationQueueSize {
+		t.Fatalf("full queue of %d expected, got %d", notificationQueueSize, len(n.queue))
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.run(stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(payloads("/discord")) < notificationQueueSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.notify(eventUpstreamDown, nil, "upstream %s down", "primary")
+	for len(payloads("/discord")) < notificationQueueSize+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// failing webhooks don't hold back the others
+	for path, count := range map[string]int{"/failing": notificationQueueSize + 1, "/json": notificationQueueSize + 1,
+		"/telegram": 1, "/discord": notificationQueueSize + 1} {
+		if got := len(payloads(path)); got != count {
+			t.Fatalf("%s: %d notifications expected, got %d", path, count, got)
+		}
+	}
+	first := payloads("/json")[0]
+	if first["event"] != eventMinerOffline || first["message"] != "miner 0 offline" || first["time"] == nil ||
+		fmt.Sprint(first["data"]) != "map[i:0]" {
+		t.Fatalf("json payload: %v", first)
+	}
+	if last := payloads("/json")[notificationQueueSize]; last["event"] != eventUpstreamDown || last["data"] != nil {
+		t.Fatalf("json payload: %v", last)
+	}
+	if p := payloads("/telegram")[0]; fmt.Sprint(p) != "map[chat_id:42 text:Aggregator farm1: upstream primary down]" {
+		t.Fatalf("telegram payload: %v", p)
+	}
+	if p := payloads("/discord")[0]; fmt.Sprint(p) != "map[content:Aggregator farm1: miner 0 offline]" {
+		t.Fatalf("discord payload: %v", p)
+	}
+}
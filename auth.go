@@ -0,0 +1,86 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MinerToken authenticates a miner, AccountIDs empty -> the miner may submit for all accounts
+type MinerToken struct {
+	Token      string   `mapstructure:"token"`
+	Name       string   `mapstructure:"name"`
+	AccountIDs []uint64 `mapstructure:"accountIds"`
+}
+
+// minerIdentity is the miner a token belongs to
+type minerIdentity struct {
+	name     string
+	nameKey  []byte // name as registry key, saves an allocation per request
+	accounts map[uint64]bool
+}
+
+// accountFilter restricts the account ids submitted to a chain
+type accountFilter struct {
+	allowed map[uint64]bool // nil -> all accounts allowed
+	denied  map[uint64]bool
+}
+
+var errUnauthorized = errors.New("missing or invalid token")
+var errAccountNotAllowed = errors.New("account id not allowed for this token")
+var errAccountNotAllowedOnChain = errors.New("account id not allowed on this chain")
+
+// loadMinerTokens maps the tokens to their identities, nil if there are none
+func loadMinerTokens(tokens []MinerToken) (map[string]*minerIdentity, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	minerTokens := make(map[string]*minerIdentity, len(tokens))
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("minerTokens[%d]: empty token", i)
+		}
+		if _, exists := minerTokens[t.Token]; exists {
+			return nil, fmt.Errorf("minerTokens[%d]: duplicate token", i)
+		}
+		id := &minerIdentity{name: t.Name, nameKey: []byte(t.Name)}
+		if len(t.AccountIDs) > 0 {
+			id.accounts = make(map[uint64]bool, len(t.AccountIDs))
+			for _, accountID := range t.AccountIDs {
+				id.accounts[accountID] = true
+			}
+		}
+		minerTokens[t.Token] = id
+	}
+	return minerTokens, nil
+}
+
+// allowed checks if the miner may submit deadlines for an account
+func (id *minerIdentity) allowed(accountID uint64) bool {
+	if id == nil || id.accounts == nil {
+		return true
+	}
+	return id.accounts[accountID]
+}
+
+func newAccountSet(ids []uint64) map[uint64]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+	set := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func newAccountFilter(allowed []uint64, denied []uint64) accountFilter {
+	return accountFilter{allowed: newAccountSet(allowed), denied: newAccountSet(denied)}
+}
+
+// permits checks the denylist first, then the allowlist if there is one
+func (f *accountFilter) permits(accountID uint64) bool {
+	if f.denied[accountID] {
+		return false
+	}
+	return f.allowed == nil || f.allowed[accountID]
+}
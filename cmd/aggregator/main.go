@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/PoC-Consortium/aggregator"
+	"github.com/spf13/viper"
+)
+
+// command line flags
+var configPath = flag.String("config", "", "path of the config file (default ./config.yaml)")
+var checkConfig = flag.Bool("check-config", false, "validate the config, print the effective configuration and exit")
+var showVersion = flag.Bool("version", false, "print the version and exit")
+
+var logMain = aggregator.Logger("main")
+
+func main() {
+	flag.Parse()
+	if *showVersion {
+		fmt.Println("Aggregator", aggregator.Version)
+		return
+	}
+	v := viper.New()
+	if err := aggregator.ReadConfig(v, *configPath); err != nil {
+		fatal("config", err)
+	}
+	if errs := aggregator.ValidateConfig(v); len(errs) > 0 {
+		for _, err := range errs {
+			logMain.Error("Invalid config", "err", err)
+		}
+		os.Exit(1)
+	}
+	if *checkConfig {
+		aggregator.SetLogHandler(slog.NewTextHandler(os.Stderr, nil))
+		if err := aggregator.LoadLogLevels(v); err != nil {
+			fatal("config", err)
+		}
+		cfg, err := aggregator.LoadConfig(v)
+		if err != nil {
+			fatal("config", err)
+		}
+		if _, err := aggregator.New(cfg); err != nil {
+			fatal("config", err)
+		}
+		if err := aggregator.PrintConfig(v, os.Stdout); err != nil {
+			fatal("config", err)
+		}
+		return
+	}
+	if err := aggregator.LoadLogging(v); err != nil {
+		fatal("logging", err)
+	}
+	logMain.Info("Aggregator", "version", aggregator.Version)
+	cfg, err := aggregator.LoadConfig(v)
+	if err != nil {
+		fatal("config", err)
+	}
+	a, err := aggregator.New(cfg)
+	if err != nil {
+		fatal("config", err)
+	}
+	if err := a.Start(); err != nil {
+		fatal("start", err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	a.Stop()
+}
+
+// fatal logs a startup error and exits
+func fatal(msg string, err error) {
+	logMain.Error(msg, "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,317 @@
+package aggregator
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config configures an Aggregator, the fields correspond to the keys of config.yaml
+type Config struct {
+	ListenAddr      string           // host:port or unix:path, empty -> not served, Handler still uses its policy
+	Listeners       []ListenerConfig // served in addition to ListenAddr
+	TLSCertFile     string           // empty -> plain http
+	TLSKeyFile      string
+	TLSClientCAFile string        // empty -> no client authentication
+	DisplayMiners   bool          // display the miners at the beginning of each round
+	StatsWindows    []int         // rounds the deadline statistics are summarized over, empty -> 10 and 360
+	ScanTime        time.Duration // the secondary chain waits for the scan of a new primary block
+
+	Primary   ChainConfig
+	Secondary ChainConfig // SubmitURL empty -> single chain
+
+	MinerName            string
+	MinerAlias           string
+	WebsocketBatchWindow time.Duration // 0 -> every submission is sent on its own
+
+	MinersPerIP      int
+	MaxMinerCapacity int64 // GiB, 0 -> no limit
+	LieDetector      bool
+	MinerTokens      []MinerToken // empty -> no authentication
+
+	RelayName  string // announced to parent aggregators of chains with Relay set
+	RelayToken string
+	Relays     []Relay // child aggregators relaying their miners to this one
+
+	RateLimit          int
+	BurstRate          int
+	SubmitRateLimit    int // 0 -> RateLimit
+	SubmitBurstRate    int
+	TrustedProxies     []string
+	RateLimitOverrides []RateQuota
+
+	Webhooks          []Webhook
+	CapacityDropAlert int64 // percent, 0 -> disabled
+}
+
+// ChainConfig configures the primary or the secondary chain
+type ChainConfig struct {
+	SubmitURL            string // http(s) pool or wallet, ws(s) for the websocket api
+	TargetDeadline       uint64
+	Passphrase           string
+	IPForwarding         bool
+	IgnoreWorseDeadlines bool
+	AccountKey           string
+	AllowedAccounts      []uint64 // empty -> all
+	DeniedAccounts       []uint64
+	Proxy                string        // http or socks5 proxy url, empty -> direct
+	DialTimeout          time.Duration // 0 -> default
+	ReadTimeout          time.Duration // 0 -> default
+	WriteTimeout         time.Duration // 0 -> default
+	Capacity             int64         // GiB reported to the pool, 0 -> sum of the miners
+	CapacityPerAccount   bool
+	BlockTime            int64  // seconds
+	StaleFactor          int64  // 0 -> stale chains are not detected
+	WalletURL            string // empty -> forged blocks are not checked
+	Relay                bool   // SubmitURL is a parent aggregator this one relays its miners to
+}
+
+// envPrefix prefixes the environment variables overriding config keys, e.g. AGGREGATOR_PRIMARYSUBMITURL
+const envPrefix = "AGGREGATOR_"
+
+// secret config keys, redacted when printing the configuration
+var secretKeys = []string{"primaryPassphrase", "secondaryPassphrase", "primaryAccountKey", "secondaryAccountKey", "minerTokens",
+	"relayToken", "relays"}
+
+// textKeys have string values, environment overrides of them are taken verbatim
+var textKeys = map[string]bool{
+	"listenAddr":      true,
+	"tlsCertFile":     true,
+	"tlsKeyFile":      true,
+	"tlsClientCAFile": true,
+	"minerName":       true,
+	"minerAlias":      true,
+	"logLevel":        true,
+	"logFormat":       true,
+	"logFile":         true,
+	"relayName":       true,
+	"relayToken":      true,
+}
+
+func init() {
+	for _, prefix := range []string{"primary", "secondary"} {
+		for _, key := range []string{"SubmitURL", "Passphrase", "AccountKey", "Proxy", "WalletURL"} {
+			textKeys[prefix+key] = true
+		}
+	}
+}
+
+// ReadConfig reads the config file into v and applies the environment overrides, path empty -> ./config.yaml
+func ReadConfig(v *viper.Viper, path string) error {
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+	}
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("config file: %s", err)
+	}
+	return applyEnvOverrides(v)
+}
+
+// LoadConfig converts the keys of v, ValidateConfig reports the errors in detail
+func LoadConfig(v *viper.Viper) (Config, error) {
+	c := Config{
+		ListenAddr:           v.GetString("listenAddr"),
+		TLSCertFile:          v.GetString("tlsCertFile"),
+		TLSKeyFile:           v.GetString("tlsKeyFile"),
+		TLSClientCAFile:      v.GetString("tlsClientCAFile"),
+		DisplayMiners:        v.GetBool("displayMiners"),
+		ScanTime:             time.Duration(v.GetInt64("scanTime")) * time.Second,
+		MinerName:            v.GetString("minerName"),
+		MinerAlias:           v.GetString("minerAlias"),
+		WebsocketBatchWindow: time.Duration(v.GetInt64("websocketBatchWindow")) * time.Millisecond,
+		MinersPerIP:          v.GetInt("minersPerIP"),
+		MaxMinerCapacity:     v.GetInt64("maxMinerCapacity"),
+		LieDetector:          v.GetBool("lieDetector"),
+		RelayName:            v.GetString("relayName"),
+		RelayToken:           v.GetString("relayToken"),
+		RateLimit:            v.GetInt("rateLimit"),
+		BurstRate:            v.GetInt("burstRate"),
+		SubmitRateLimit:      v.GetInt("submitRateLimit"),
+		SubmitBurstRate:      v.GetInt("submitBurstRate"),
+		TrustedProxies:       v.GetStringSlice("trustedProxies"),
+		CapacityDropAlert:    v.GetInt64("capacityDropAlert"),
+	}
+	var err error
+	if c.Primary, err = loadChainConfig(v, "primary"); err != nil {
+		return c, err
+	}
+	if c.Secondary, err = loadChainConfig(v, "secondary"); err != nil {
+		return c, err
+	}
+	if err := v.UnmarshalKey("minerTokens", &c.MinerTokens); err != nil {
+		return c, fmt.Errorf("minerTokens: %s", err)
+	}
+	if err := v.UnmarshalKey("rateLimitOverrides", &c.RateLimitOverrides); err != nil {
+		return c, fmt.Errorf("rateLimitOverrides: %s", err)
+	}
+	if err := v.UnmarshalKey("statsWindows", &c.StatsWindows); err != nil {
+		return c, fmt.Errorf("statsWindows: %s", err)
+	}
+	if err := v.UnmarshalKey("relays", &c.Relays); err != nil {
+		return c, fmt.Errorf("relays: %s", err)
+	}
+	if err := v.UnmarshalKey("listeners", &c.Listeners); err != nil {
+		return c, fmt.Errorf("listeners: %s", err)
+	}
+	if err := v.UnmarshalKey("webhooks", &c.Webhooks); err != nil {
+		return c, fmt.Errorf("webhooks: %s", err)
+	}
+	return c, nil
+}
+
+func loadChainConfig(v *viper.Viper, prefix string) (ChainConfig, error) {
+	c := ChainConfig{
+		SubmitURL:            v.GetString(prefix + "SubmitURL"),
+		TargetDeadline:       uint64(v.GetInt64(prefix + "TargetDeadline")),
+		Passphrase:           v.GetString(prefix + "Passphrase"),
+		IPForwarding:         v.GetBool(prefix + "IpForwarding"),
+		IgnoreWorseDeadlines: v.GetBool(prefix + "IgnoreWorseDeadlines"),
+		AccountKey:           v.GetString(prefix + "AccountKey"),
+		Proxy:                v.GetString(prefix + "Proxy"),
+		DialTimeout:          secondsSetting(v, prefix+"DialTimeout"),
+		ReadTimeout:          secondsSetting(v, prefix+"ReadTimeout"),
+		WriteTimeout:         secondsSetting(v, prefix+"WriteTimeout"),
+		Capacity:             v.GetInt64(prefix + "Capacity"),
+		CapacityPerAccount:   v.GetBool(prefix + "CapacityPerAccount"),
+		BlockTime:            v.GetInt64(prefix + "BlockTime"),
+		StaleFactor:          v.GetInt64(prefix + "StaleFactor"),
+		WalletURL:            v.GetString(prefix + "WalletURL"),
+		Relay:                v.GetBool(prefix + "Relay"),
+	}
+	for key, ids := range map[string]*[]uint64{prefix + "AllowedAccounts": &c.AllowedAccounts, prefix + "DeniedAccounts": &c.DeniedAccounts} {
+		if err := v.UnmarshalKey(key, ids); err != nil {
+			return c, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return c, nil
+}
+
+// secondsSetting reads a config value in seconds
+func secondsSetting(v *viper.Viper, key string) time.Duration {
+	return time.Duration(v.GetFloat64(key) * float64(time.Second))
+}
+
+// configKeys returns the top level keys of the config file in file order
+func configKeys(v *viper.Viper) (yaml.MapSlice, error) {
+	raw, err := ioutil.ReadFile(v.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	var keys yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// applyEnvOverrides sets every known config key found as environment variable. String values are taken
+// verbatim, all others are parsed as yaml so lists and maps can be overridden as well,
+// e.g. AGGREGATOR_TRUSTEDPROXIES='["10.0.0.1"]'
+func applyEnvOverrides(v *viper.Viper) error {
+	for key := range configSchema {
+		s, ok := os.LookupEnv(envName(key))
+		if !ok {
+			continue
+		}
+		if textKeys[key] {
+			v.Set(key, s)
+			continue
+		}
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(s), &value); err != nil {
+			return fmt.Errorf("%s: %s", envName(key), err)
+		}
+		if value == nil {
+			value = ""
+		}
+		v.Set(key, value)
+	}
+	return nil
+}
+
+// PrintConfig writes the effective configuration of the config file and the environment as yaml, secrets redacted
+func PrintConfig(v *viper.Viper, w io.Writer) error {
+	keys := make([]string, 0, len(configSchema))
+	for key := range configSchema {
+		if v.IsSet(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	effective := make(yaml.MapSlice, 0, len(keys))
+	for _, key := range keys {
+		effective = append(effective, yaml.MapItem{Key: key, Value: redact(key, v.Get(key))})
+	}
+	out, err := yaml.Marshal(effective)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// redact hides the secrets of a config value: secret keys and webhook urls entirely, credentials of other urls
+func redact(key string, value interface{}) interface{} {
+	for _, secret := range secretKeys {
+		if key == secret && value != nil && fmt.Sprint(value) != "" && fmt.Sprint(value) != "[]" {
+			return "<redacted>"
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		return redactUserinfo(value)
+	case []interface{}:
+		if key != "webhooks" {
+			return value
+		}
+		// bot tokens are part of the url
+		hooks := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			hook := make(map[string]interface{})
+			switch item := item.(type) {
+			case map[string]interface{}:
+				for k, v := range item {
+					hook[k] = v
+				}
+			case map[interface{}]interface{}:
+				for k, v := range item {
+					hook[fmt.Sprint(k)] = v
+				}
+			default:
+				hooks = append(hooks, item)
+				continue
+			}
+			if _, exists := hook["url"]; exists {
+				hook["url"] = "<redacted>"
+			}
+			hooks = append(hooks, hook)
+		}
+		return hooks
+	}
+	return value
+}
+
+// redactUserinfo hides user and password of a url, e.g. of a socks5 proxy
+func redactUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://<redacted>@", 1)
+}
@@ -1,105 +0,0 @@
-package main
-
-import (
-	"io"
-	"net/http"
-	"net/url"
-
-	"github.com/valyala/fasthttp"
-)
-
-// NewFastHTTPHandler converts a standard http.Handler to a fasthttp.RequestHandler
-func NewFastHTTPHandler(h http.Handler) fasthttp.RequestHandler {
-	return func(ctx *fasthttp.RequestCtx) {
-		var r http.Request
-
-		body := ctx.PostBody()
-		r.Method = string(ctx.Method())
-		r.Proto = "HTTP/1.1"
-		r.ProtoMajor = 1
-		r.ProtoMinor = 1
-		r.RequestURI = string(ctx.RequestURI())
-		r.ContentLength = int64(len(body))
-		r.Host = string(ctx.Host())
-		r.RemoteAddr = ctx.RemoteAddr().String()
-
-		hdr := make(http.Header)
-		ctx.Request.Header.VisitAll(func(k, v []byte) {
-			sk := string(k)
-			sv := string(v)
-			switch sk {
-			case "Transfer-Encoding":
-				r.TransferEncoding = append(r.TransferEncoding, sv)
-			default:
-				hdr.Set(sk, sv)
-			}
-		})
-		r.Header = hdr
-		r.Body = &netHTTPBody{body}
-		rURL, err := url.ParseRequestURI(r.RequestURI)
-		if err != nil {
-			ctx.Logger().Printf("cannot parse requestURI %q: %s", r.RequestURI, err)
-			ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
-			return
-		}
-		r.URL = rURL
-
-		var w netHTTPResponseWriter
-		h.ServeHTTP(&w, &r)
-
-		ctx.SetStatusCode(w.StatusCode())
-		for k, vv := range w.Header() {
-			for _, v := range vv {
-				ctx.Response.Header.Set(k, v)
-			}
-		}
-		ctx.Write(w.body)
-	}
-}
-
-type netHTTPBody struct {
-	b []byte
-}
-
-func (r *netHTTPBody) Read(p []byte) (int, error) {
-	if len(r.b) == 0 {
-		return 0, io.EOF
-	}
-	n := copy(p, r.b)
-	r.b = r.b[n:]
-	return n, nil
-}
-
-func (r *netHTTPBody) Close() error {
-	r.b = r.b[:0]
-	return nil
-}
-
-type netHTTPResponseWriter struct {
-	statusCode int
-	h          http.Header
-	body       []byte
-}
-
-func (w *netHTTPResponseWriter) StatusCode() int {
-	if w.statusCode == 0 {
-		return http.StatusOK
-	}
-	return w.statusCode
-}
-
-func (w *netHTTPResponseWriter) Header() http.Header {
-	if w.h == nil {
-		w.h = make(http.Header)
-	}
-	return w.h
-}
-
-func (w *netHTTPResponseWriter) WriteHeader(statusCode int) {
-	w.statusCode = statusCode
-}
-
-func (w *netHTTPResponseWriter) Write(p []byte) (int, error) {
-	w.body = append(w.body, p...)
-	return len(p), nil
-}
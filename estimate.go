@@ -0,0 +1,80 @@
+package aggregator
+
+import "math"
+
+const (
+	estimationRounds    = 360 // rounds used for an estimation, about a day of blocks
+	minEstimationRounds = 10  // estimations based on less rounds are too noisy to show
+	noncesPerGiB        = 4096
+)
+
+// capacityEstimator estimates plot size from the best deadline per round.
+// Every nonce yields a uniformly distributed hit, the best hit of N nonces normalized to [0, 1)
+// is approximately exponentially distributed with rate N, so N is estimated by (k-1)/sum over k rounds.
+// Rounds a miner didn't submit anything for are unknown and ignored, a miner filtering
+// with a low target deadline is therefore overestimated.
+// Both chains are mined with the same plots, their rounds are tracked apart and estimated together.
+type capacityEstimator struct {
+	pending [2]map[uint64]float64 // per chain: height -> best normalized hit, rounds still running
+	hits    []float64             // finished rounds, ring buffer
+	next    int
+}
+
+// add records a deadline in seconds submitted for height of the primary or secondary chain
+func (e *capacityEstimator) add(primary bool, height uint64, baseTarget uint64, deadline uint64) {
+	// the deadline is truncated to seconds, assume the middle of the second
+	x := float64(baseTarget) * (float64(deadline) + 0.5) / math.Exp2(64)
+	chain := 0
+	if !primary {
+		chain = 1
+	}
+	if e.pending[chain] == nil {
+		e.pending[chain] = make(map[uint64]float64, 2)
+	}
+	pending := e.pending[chain]
+	if best, exists := pending[height]; exists {
+		if x < best {
+			pending[height] = x
+		}
+		return
+	}
+	// keep the current and the previous round open for late submissions
+	for len(pending) >= 2 {
+		oldest := height
+		for h := range pending {
+			if h < oldest {
+				oldest = h
+			}
+		}
+		if oldest == height {
+			// submission for a round that is already finished
+			return
+		}
+		e.push(pending[oldest])
+		delete(pending, oldest)
+	}
+	pending[height] = x
+}
+
+func (e *capacityEstimator) push(x float64) {
+	if len(e.hits) < estimationRounds {
+		e.hits = append(e.hits, x)
+		return
+	}
+	e.hits[e.next] = x
+	e.next = (e.next + 1) % estimationRounds
+}
+
+// estimate returns the estimated capacity in GiB and the number of rounds it is based on
+func (e *capacityEstimator) estimate() (int64, int) {
+	rounds := len(e.hits)
+	if rounds < minEstimationRounds {
+		return 0, rounds
+	}
+	var sum float64
+	for _, x := range e.hits {
+		sum += x
+	}
+	nonces := float64(rounds-1) / sum
+	return int64(nonces / noncesPerGiB), rounds
+}
@@ -0,0 +1,133 @@
+package aggregator
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+const eventBlockForged = "block_forged"
+
+// roundTracker collects the deadlines forwarded for the current block of a chain
+// and checks with the wallet whether one of them forged the block
+type roundTracker struct {
+	name          string
+	wallet        *upstream // nil -> forged blocks are not checked
+	notifications *notifier
+	ctx           context.Context // cancelled on Stop, no more blocks are checked
+	wg            *sync.WaitGroup // waited for by Stop
+
+	sync.Mutex
+	height      uint64
+	best        uint64
+	bestAccount uint64
+	accounts    map[uint64]struct{} // accounts deadlines were forwarded for
+
+	rounds uint64 // rounds with forwarded deadlines, atomic
+	forged uint64 // blocks forged, atomic
+}
+
+// finishedRound is the summary of a round handed to the wallet check
+type finishedRound struct {
+	height      uint64
+	best        uint64
+	bestAccount uint64
+	accounts    map[uint64]struct{}
+}
+
+// submitted records a deadline forwarded to the chain
+func (t *roundTracker) submitted(height uint64, accountID uint64, deadline uint64) {
+	t.Lock()
+	defer t.Unlock()
+	if height != t.height {
+		return
+	}
+	if t.accounts == nil {
+		t.accounts = make(map[uint64]struct{})
+	}
+	t.accounts[accountID] = struct{}{}
+	if deadline < t.best {
+		t.best = deadline
+		t.bestAccount = accountID
+	}
+}
+
+// newBlock summarizes the finished round and starts a new one for height
+func (t *roundTracker) newBlock(height uint64) {
+	t.Lock()
+	r := finishedRound{height: t.height, best: t.best, bestAccount: t.bestAccount, accounts: t.accounts}
+	t.height = height
+	t.best = ^uint64(0)
+	t.bestAccount = 0
+	t.accounts = nil
+	t.Unlock()
+
+	// first block after start or a reorg to the same height
+	if r.height == 0 || r.height == height {
+		return
+	}
+	if len(r.accounts) == 0 {
+		logChain.Info("Round summary", "chain", t.name, "height", r.height, "deadlines", 0)
+		return
+	}
+	atomic.AddUint64(&t.rounds, 1)
+	logChain.Info("Round summary", "chain", t.name, "height", r.height, "bestDeadline", r.best, "accountId", r.bestAccount,
+		"accounts", len(r.accounts))
+	if t.wallet != nil && height > r.height && t.ctx.Err() == nil {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.checkForged(r)
+		}()
+	}
+}
+
+// checkForged asks the wallet for the generator of a finished block
+func (t *roundTracker) checkForged(r finishedRound) {
+	var block struct {
+		Generator string `json:"generator"`
+		Block     string `json:"block"`
+		ErrorCode int    `json:"errorCode"`
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.URI().Update(t.wallet.url + "/burst?requestType=getBlock&height=" + strconv.FormatUint(r.height, 10))
+	req.Header.Set("User-Agent", "Aggregator/"+Version)
+	req.Header.SetMethodBytes([]byte("GET"))
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	// the request is bounded by the timeouts of the wallet, Stop waits for it
+	if err := t.wallet.do(req, resp); err != nil {
+		if t.ctx.Err() == nil {
+			logChain.Warn("Block check failed", "chain", t.name, "height", r.height, "err", err)
+		}
+		return
+	}
+	if t.ctx.Err() != nil {
+		return
+	}
+	if err := jsonx.Unmarshal(resp.Body(), &block); err != nil || block.ErrorCode != 0 {
+		logChain.Warn("Block check failed", "chain", t.name, "height", r.height, "response", string(resp.Body()))
+		return
+	}
+	generator, err := strconv.ParseUint(block.Generator, 10, 64)
+	if err != nil {
+		logChain.Warn("Block check failed", "chain", t.name, "height", r.height, "generator", block.Generator)
+		return
+	}
+	if _, ours := r.accounts[generator]; !ours {
+		return
+	}
+	atomic.AddUint64(&t.forged, 1)
+	logChain.Info("Block forged", "chain", t.name, "height", r.height, "block", block.Block, "accountId", generator)
+	t.notifications.notify(eventBlockForged, map[string]interface{}{"chain": t.name, "height": r.height, "block": block.Block, "accountId": generator},
+		"%s chain block %d forged by account %d", t.name, r.height, generator)
+}
+
+// stats returns the blocks forged and the rounds deadlines were forwarded for
+func (t *roundTracker) stats() (forged uint64, rounds uint64) {
+	return atomic.LoadUint64(&t.forged), atomic.LoadUint64(&t.rounds)
+}
@@ -0,0 +1,181 @@
+package aggregator
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// forkMemory is the number of heights around the current one whose blocks and best submissions are remembered
+const forkMemory = 10
+
+// blockEvent classifies the mining info fetched for a chain
+type blockEvent int
+
+const (
+	blockUnchanged blockEvent = iota
+	blockNew                  // next height
+	blockReorg                // a known height with a new generation signature
+	blockRollback             // a lower height, the chain dropped blocks
+	blockRetarget             // the current block with a new base target
+)
+
+func (e blockEvent) String() string {
+	switch e {
+	case blockNew:
+		return "new"
+	case blockReorg:
+		return "reorg"
+	case blockRollback:
+		return "rollback"
+	case blockRetarget:
+		return "retarget"
+	}
+	return "unchanged"
+}
+
+// replaces reports whether the block replaced blocks mined on before
+func (e blockEvent) replaces() bool {
+	return e == blockReorg || e == blockRollback
+}
+
+// blockID identifies the block mined on
+type blockID struct {
+	height     uint64
+	baseTarget uint64
+	genSig     string
+}
+
+// bestSubmission is the best deadline forwarded for a height
+type bestSubmission struct {
+	round    minerRound
+	deadline uint64
+}
+
+// forkDetector compares the mining info of a chain with the blocks seen before
+type forkDetector struct {
+	name string
+
+	sync.Mutex
+	last   blockID
+	genSig map[uint64]string         // height -> generation signature of recent blocks
+	best   map[uint64]bestSubmission // height -> best deadline forwarded, recent heights
+	reorgs uint64                    // reorgs and rollbacks, atomic
+}
+
+func newForkDetector(name string) *forkDetector {
+	return &forkDetector{name: name, genSig: make(map[uint64]string), best: make(map[uint64]bestSubmission)}
+}
+
+// detect classifies mi and makes it the last block, prev is the block mined on before
+func (f *forkDetector) detect(mi *miningInfo) (event blockEvent, prev blockID) {
+	cur := blockID{height: uint64(mi.Height), baseTarget: uint64(mi.BaseTarget), genSig: mi.GenSig}
+	f.Lock()
+	defer f.Unlock()
+	prev = f.last
+	genSig, seen := f.genSig[cur.height]
+	switch {
+	case cur == prev:
+		return blockUnchanged, prev
+	case prev.height == 0:
+		event = blockNew
+	case cur.height < prev.height:
+		event = blockRollback
+	case cur.height == prev.height && cur.genSig == prev.genSig:
+		event = blockRetarget
+	case cur.height == prev.height || (seen && genSig != cur.genSig):
+		event = blockReorg
+	default:
+		event = blockNew
+	}
+	f.last = cur
+	f.genSig[cur.height] = cur.genSig
+	for height := range f.genSig {
+		if height+forkMemory < cur.height || height > cur.height+forkMemory {
+			delete(f.genSig, height)
+		}
+	}
+	for height := range f.best {
+		if height+forkMemory < cur.height || height > cur.height+forkMemory {
+			delete(f.best, height)
+		}
+	}
+	if event.replaces() {
+		atomic.AddUint64(&f.reorgs, 1)
+	}
+	return event, prev
+}
+
+// submitted remembers the best deadline forwarded for a height
+func (f *forkDetector) submitted(round *minerRound, deadline uint64) {
+	f.Lock()
+	defer f.Unlock()
+	if best, exists := f.best[round.Height]; !exists || deadline < best.deadline {
+		f.best[round.Height] = bestSubmission{round: *round, deadline: deadline}
+	}
+}
+
+// replaced returns and forgets the best deadline forwarded for a height whose block was replaced,
+// it was found for the old generation signature
+func (f *forkDetector) replaced(height uint64) (bestSubmission, bool) {
+	f.Lock()
+	defer f.Unlock()
+	best, exists := f.best[height]
+	delete(f.best, height)
+	return best, exists
+}
+
+// reorgCount returns the reorgs and rollbacks detected
+func (f *forkDetector) reorgCount() uint64 {
+	return atomic.LoadUint64(&f.reorgs)
+}
+
+// resubmit forwards the best nonce of a height again after the height reappeared in a reorg or rollback.
+// No deadline is sent, the upstream computes it for the current generation signature and it is remembered
+// for the new block.
+func (a *Aggregator) resubmit(c *chain, best bestSubmission) {
+	round := best.round
+	height := round.Height
+	if c.ws {
+		// the websocket api needs the deadline of the nonce, which changes with the generation signature
+		logChain.Info("Resubmission skipped", "chain", c.name, "height", height, "reason", "websocket api")
+		return
+	}
+	if c.cfg.Passphrase != "" {
+		round.Passphrase = c.cfg.Passphrase
+	}
+	args := "requestType=submitNonce&accountId=" + strconv.FormatUint(round.AccountID, 10) +
+		"&nonce=" + strconv.FormatUint(round.Nonce, 10) + "&blockheight=" + strconv.FormatUint(round.Height, 10)
+	if round.Passphrase != "" {
+		args += "&secretPhrase=" + url.QueryEscape(round.Passphrase)
+	}
+
+	u := c.upstream
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.URI().Update(u.url + "/burst?" + args)
+	req.Header.Set("User-Agent", "Aggregator/"+Version)
+	req.Header.Set("X-Miner", "Aggregator/"+Version)
+	req.Header.Set("X-MinerAlias", a.cfg.MinerAlias)
+	req.Header.Set("X-Capacity", strconv.FormatInt(u.reportedCapacity(round.AccountID), 10))
+	req.Header.Set("X-Account", c.cfg.AccountKey)
+	u.setRelayHeaders(req)
+	req.Header.SetMethodBytes([]byte("POST"))
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := u.do(req, resp); err != nil {
+		logChain.Warn("Resubmission failed", "chain", c.name, "height", height, "accountId", round.AccountID, "err", err)
+		return
+	}
+	var sr submitResponse
+	if err := jsonx.Unmarshal(resp.Body(), &sr); err != nil || resp.StatusCode() != fasthttp.StatusOK {
+		logChain.Warn("Resubmission failed", "chain", c.name, "height", height, "accountId", round.AccountID, "response", string(resp.Body()))
+		return
+	}
+	logChain.Info("Best deadline resubmitted", "chain", c.name, "height", height, "accountId", round.AccountID, "nonce", round.Nonce,
+		"previousDeadline", best.deadline, "deadline", sr.Deadline)
+	c.forks.submitted(&best.round, uint64(sr.Deadline))
+}
@@ -0,0 +1,596 @@
+package aggregator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+)
+
+// fakeBlock is the mining info served by the fake servers
+type fakeBlock struct {
+	Height     uint64
+	BaseTarget uint64
+	GenSig     string
+}
+
+func (b fakeBlock) miningInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"height":              strconv.FormatUint(b.Height, 10),
+		"baseTarget":          strconv.FormatUint(b.BaseTarget, 10),
+		"generationSignature": b.GenSig,
+		"targetDeadline":      31536000,
+	}
+}
+
+// fakeSubmission is a nonce received by a fake server
+type fakeSubmission struct {
+	AccountID uint64
+	Height    uint64
+	Nonce     uint64
+	Deadline  uint64 // as sent, unadjusted for http pools
+}
+
+// fakePool is a Burst API pool or wallet serving getMiningInfo, submitNonce and getBlock
+type fakePool struct {
+	srv *httptest.Server
+
+	sync.Mutex
+	block       fakeBlock
+	down        bool                          // answer every request with 503
+	respond     func(s fakeSubmission) string // submitNonce response, honest by default
+	generators  map[uint64]uint64             // height -> generator for getBlock
+	submissions []fakeSubmission
+	capacities  []string // X-Capacity of the submissions
+}
+
+func newFakePool(t testing.TB, block fakeBlock) *fakePool {
+	p := &fakePool{block: block, generators: make(map[uint64]uint64)}
+	p.srv = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *fakePool) serve(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	if p.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	switch q.Get("requestType") {
+	case "getMiningInfo":
+		json.NewEncoder(w).Encode(p.block.miningInfo())
+	case "submitNonce":
+		s := fakeSubmission{}
+		s.AccountID, _ = strconv.ParseUint(q.Get("accountId"), 10, 64)
+		s.Height, _ = strconv.ParseUint(q.Get("blockheight"), 10, 64)
+		s.Nonce, _ = strconv.ParseUint(q.Get("nonce"), 10, 64)
+		s.Deadline, _ = strconv.ParseUint(q.Get("deadline"), 10, 64)
+		p.submissions = append(p.submissions, s)
+		p.capacities = append(p.capacities, r.Header.Get("X-Capacity"))
+		if p.respond != nil {
+			io.WriteString(w, p.respond(s))
+			return
+		}
+		fmt.Fprintf(w, "{\"deadline\":%d,\"result\":\"success\"}", s.Deadline/p.block.BaseTarget)
+	case "getBlock":
+		height, _ := strconv.ParseUint(q.Get("height"), 10, 64)
+		generator, exists := p.generators[height]
+		if !exists {
+			io.WriteString(w, "{\"errorCode\":5,\"errorDescription\":\"Unknown block\"}")
+			return
+		}
+		fmt.Fprintf(w, "{\"block\":\"%d\",\"height\":%d,\"generator\":\"%d\"}", height*7, height, generator)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (p *fakePool) url() string {
+	return p.srv.URL
+}
+
+func (p *fakePool) setBlock(b fakeBlock) {
+	p.Lock()
+	p.block = b
+	p.Unlock()
+}
+
+func (p *fakePool) setDown(down bool) {
+	p.Lock()
+	p.down = down
+	p.Unlock()
+}
+
+func (p *fakePool) received() []fakeSubmission {
+	p.Lock()
+	defer p.Unlock()
+	return append([]fakeSubmission(nil), p.submissions...)
+}
+
+// receivedCapacities returns the X-Capacity headers of the submissions received
+func (p *fakePool) receivedCapacities() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.capacities...)
+}
+
+// fakeWebsocketPool is a HDPool style websocket api
+type fakeWebsocketPool struct {
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	sync.Mutex
+	block       fakeBlock
+	conns       map[*websocket.Conn]bool
+	accepted    int // connections accepted so far
+	messages    int // submit_nonce messages received
+	submissions []fakeSubmission
+}
+
+func newFakeWebsocketPool(t testing.TB, block fakeBlock) *fakeWebsocketPool {
+	p := &fakeWebsocketPool{block: block, conns: make(map[*websocket.Conn]bool)}
+	p.srv = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(func() {
+		p.disconnect()
+		p.srv.Close()
+	})
+	return p
+}
+
+func (p *fakeWebsocketPool) url() string {
+	return "ws" + strings.TrimPrefix(p.srv.URL, "http")
+}
+
+func (p *fakeWebsocketPool) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	p.Lock()
+	p.conns[conn] = true
+	p.accepted++
+	p.Unlock()
+	defer func() {
+		p.Lock()
+		delete(p.conns, conn)
+		p.Unlock()
+		conn.Close()
+	}()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg struct {
+			Cmd  string          `json:"cmd"`
+			Para json.RawMessage `json:"para"`
+		}
+		if json.Unmarshal(message, &msg) != nil {
+			continue
+		}
+		switch msg.Cmd {
+		case "mining_info":
+			p.Lock()
+			err = conn.WriteJSON(map[string]interface{}{"cmd": "mining_info", "para": p.block.miningInfo()})
+			p.Unlock()
+		case "poolmgr.heartbeat":
+			p.Lock()
+			err = conn.WriteJSON(map[string]interface{}{"cmd": "poolmgr.heartbeat", "para": map[string]string{}})
+			p.Unlock()
+		case "poolmgr.submit_nonce":
+			var ns nonceSubmission
+			if json.Unmarshal(msg.Para, &ns) == nil {
+				p.Lock()
+				p.messages++
+				for _, nd := range ns.Submit {
+					nonce, _ := strconv.ParseUint(nd.Nonce, 10, 64)
+					p.submissions = append(p.submissions, fakeSubmission{nd.AccountID, nd.Height, nonce, nd.Deadline})
+				}
+				p.Unlock()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setBlock pushes a new block to all subscribers
+func (p *fakeWebsocketPool) setBlock(b fakeBlock) {
+	p.Lock()
+	defer p.Unlock()
+	p.block = b
+	for conn := range p.conns {
+		conn.WriteJSON(map[string]interface{}{"cmd": "poolmgr.mining_info", "para": b.miningInfo()})
+	}
+}
+
+// disconnect drops all connections, the proxy has to reconnect
+func (p *fakeWebsocketPool) disconnect() {
+	p.Lock()
+	defer p.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *fakeWebsocketPool) connections() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.accepted
+}
+
+func (p *fakeWebsocketPool) submitMessages() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.messages
+}
+
+func (p *fakeWebsocketPool) received() []fakeSubmission {
+	p.Lock()
+	defer p.Unlock()
+	return append([]fakeSubmission(nil), p.submissions...)
+}
+
+// fakeMiner sends requests to the proxy handler as a miner at ip
+type fakeMiner struct {
+	t         testing.TB
+	handler   fasthttp.RequestHandler
+	ip        net.IP
+	name      string
+	capacity  string // X-Capacity in GiB, empty -> not sent
+	forwarded string // X-Forwarded-For, empty -> not sent
+}
+
+func (m *fakeMiner) do(uri string) (int, map[string]interface{}) {
+	var req fasthttp.Request
+	req.SetRequestURI(uri)
+	req.Header.Set("User-Agent", "fake-miner/1.0")
+	req.Header.Set("X-Minername", m.name)
+	if m.capacity != "" {
+		req.Header.Set("X-Capacity", m.capacity)
+	}
+	if m.forwarded != "" {
+		req.Header.Set("X-Forwarded-For", m.forwarded)
+	}
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: m.ip, Port: 50000}, nil)
+	m.handler(&ctx)
+	var body map[string]interface{}
+	if err := json.Unmarshal(ctx.Response.Body(), &body); err != nil {
+		m.t.Fatalf("%s: invalid response %q", uri, ctx.Response.Body())
+	}
+	return ctx.Response.StatusCode(), body
+}
+
+// getMiningInfo returns the height served to the miner
+func (m *fakeMiner) getMiningInfo() uint64 {
+	status, body := m.do("/burst?requestType=getMiningInfo")
+	if status != fasthttp.StatusOK {
+		m.t.Fatalf("getMiningInfo: status %d", status)
+	}
+	height, _ := strconv.ParseUint(fmt.Sprint(body["height"]), 10, 64)
+	return height
+}
+
+// submitNonce submits an unadjusted deadline, returns the status and the response
+func (m *fakeMiner) submitNonce(accountID, nonce, height, deadline uint64) (int, map[string]interface{}) {
+	return m.do(fmt.Sprintf("/burst?requestType=submitNonce&accountId=%d&nonce=%d&blockheight=%d&deadline=%d",
+		accountID, nonce, height, deadline))
+}
+
+// lockedBuffer collects log output written concurrently
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// harness runs the proxy in process against fake chains, settings are config keys
+type harness struct {
+	t testing.TB
+	a *Aggregator
+}
+
+func newHarness(t testing.TB, settings map[string]interface{}) *harness {
+	SetLogHandler(slog.NewTextHandler(io.Discard, nil))
+	v := viper.New()
+	v.Set("listenAddr", "")
+	v.Set("primaryTargetDeadline", 31536000)
+	v.Set("secondaryTargetDeadline", 31536000)
+	v.Set("minersPerIP", 10)
+	v.Set("rateLimit", 1000000)
+	v.Set("burstRate", 1000000)
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+	cfg, err := LoadConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the websocket api is connected, mining info is refreshed by the tests
+	if err := a.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Stop)
+	return &harness{t: t, a: a}
+}
+
+// miner creates a fake miner at ip
+func (h *harness) miner(ip string, name string) *fakeMiner {
+	return &fakeMiner{t: h.t, handler: h.a.Handler(), ip: net.ParseIP(ip), name: name, capacity: "1024"}
+}
+
+// refresh runs a mining info refresh and the stale chain check like the ticker of main does
+func (h *harness) refresh() {
+	h.a.refreshMiningInfo()
+	h.a.checkStaleChains()
+}
+
+// stale backdates the last block of c, the next refresh finds it stale
+func (h *harness) stale(c *chain) {
+	atomic.StoreInt64(&c.health.lastBlock, time.Now().Add(-c.health.staleAfter-time.Minute).UnixNano())
+}
+
+// eventually polls cond until it holds or the timeout passes
+func (h *harness) eventually(timeout time.Duration, what string, cond func() bool) {
+	h.t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	h.t.Fatalf("timeout waiting for %s", what)
+}
+
+// testCA issues certificates for the tls tests
+type testCA struct {
+	t    testing.TB
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t testing.TB) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{t: t, cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a pem encoded certificate and key for 127.0.0.1, usable by servers and clients
+func (ca *testCA) issue(serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// write stores a certificate and key issued by the ca in dir
+func (ca *testCA) write(dir string, serial int64) (certFile string, keyFile string) {
+	certPEM, keyPEM := ca.issue(serial)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// fakeProxy is an http CONNECT or socks5 proxy tunneling to the requested address, it records the
+// requested address and credentials and rejects all tunnels if reject is set
+type fakeProxy struct {
+	ln     net.Listener
+	reject atomic.Bool
+
+	sync.Mutex
+	target string // address requested by the last client
+	byName bool   // the last client sent a host name instead of an ip
+	auth   string // user:password of the last client
+}
+
+func newFakeProxy(t testing.TB, socks bool) *fakeProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if socks {
+				go p.serveSocks5(conn)
+			} else {
+				go p.serveConnect(conn)
+			}
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *fakeProxy) requested() (target string, byName bool, auth string) {
+	p.Lock()
+	defer p.Unlock()
+	return p.target, p.byName, p.auth
+}
+
+func (p *fakeProxy) record(target string, byName bool, auth string) {
+	p.Lock()
+	defer p.Unlock()
+	p.target, p.byName, p.auth = target, byName, auth
+}
+
+func (p *fakeProxy) serveConnect(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	var auth string
+	if user, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth(); ok {
+		auth = user + ":" + password
+	}
+	p.record(req.Host, false, auth)
+	if p.reject.Load() {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	p.tunnel(conn, req.Host)
+}
+
+func (p *fakeProxy) serveSocks5(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	conn.Write([]byte{5, methods[0]})
+	var auth string
+	if methods[0] == 2 {
+		// version, username, password
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(r, user)
+		io.ReadFull(r, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(r, password)
+		auth = string(user) + ":" + string(password)
+		conn.Write([]byte{1, 0})
+	}
+	// version, command, reserved, address type
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(r, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case 3:
+		io.ReadFull(r, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	case 4:
+		io.ReadFull(r, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	}
+	io.ReadFull(r, buf[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	p.record(target, buf[3] == 3, auth)
+	if p.reject.Load() {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	p.tunnel(conn, target)
+}
+
+// tunnel connects conn with addr until either side closes
+func (p *fakeProxy) tunnel(conn net.Conn, addr string) {
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
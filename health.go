@@ -0,0 +1,124 @@
+package aggregator
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// chainHealth tracks when a chain last produced a new block
+type chainHealth struct {
+	name       string
+	lastBlock  int64 // unix nanos
+	staleAfter time.Duration
+	unhealthy  atomicBool
+	lastHeight uint64
+	lastGenSig atomic.Value
+	failures   int32 // consecutive failed mining info fetches
+	down       atomicBool
+
+	notifications *notifier
+}
+
+// upstreams failing to deliver mining info for upstreamDownAfter consecutive fetches are reported down
+const upstreamDownAfter = 5
+
+func newStaleThreshold(blockTime int64, staleFactor int64) time.Duration {
+	return time.Duration(blockTime*staleFactor) * time.Second
+}
+
+// init sets the threshold and starts counting from now
+func (h *chainHealth) init(staleAfter time.Duration) {
+	h.staleAfter = staleAfter
+	atomic.StoreInt64(&h.lastBlock, time.Now().UnixNano())
+}
+
+// update is fed with every mining info fetched, only a changed height or generation signature counts as new block
+func (h *chainHealth) update(mi *miningInfo) {
+	genSig, _ := h.lastGenSig.Load().(string)
+	if atomic.LoadUint64(&h.lastHeight) == uint64(mi.Height) && genSig == mi.GenSig {
+		return
+	}
+	atomic.StoreUint64(&h.lastHeight, uint64(mi.Height))
+	h.lastGenSig.Store(mi.GenSig)
+	h.newBlock()
+}
+
+// fetched is fed with the result of every mining info fetch and reports upstream outages and recoveries
+func (h *chainHealth) fetched(err error) {
+	if err == nil {
+		atomic.StoreInt32(&h.failures, 0)
+		if h.down.Get() {
+			h.down.Set(false)
+			logChain.Info("Upstream recovered", "chain", h.name)
+			h.notifications.notify(eventUpstreamUp, map[string]string{"chain": h.name}, "%s chain upstream recovered", h.name)
+		}
+		return
+	}
+	if atomic.AddInt32(&h.failures, 1) == upstreamDownAfter {
+		h.down.Set(true)
+		logChain.Error("Upstream down", "chain", h.name, "err", err)
+		h.notifications.notify(eventUpstreamDown, map[string]string{"chain": h.name, "error": err.Error()}, "%s chain upstream down: %s", h.name, err)
+	}
+}
+
+// newBlock marks the chain as alive
+func (h *chainHealth) newBlock() {
+	atomic.StoreInt64(&h.lastBlock, time.Now().UnixNano())
+	if h.unhealthy.Get() {
+		h.unhealthy.Set(false)
+		logChain.Info("Chain recovered", "chain", h.name)
+	}
+}
+
+// sinceLastBlock returns the time passed since the last new block
+func (h *chainHealth) sinceLastBlock() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.lastBlock)))
+}
+
+// Healthy reports whether the chain delivered a new block within its threshold
+func (h *chainHealth) Healthy() bool {
+	return !h.unhealthy.Get()
+}
+
+// check marks the chain unhealthy once the threshold is exceeded, returns true on that transition
+func (h *chainHealth) check() bool {
+	if h.staleAfter <= 0 || h.unhealthy.Get() {
+		return false
+	}
+	since := h.sinceLastBlock()
+	if since <= h.staleAfter {
+		return false
+	}
+	h.unhealthy.Set(true)
+	logChain.Warn("Chain stale", "chain", h.name, "sinceLastBlock", since.Round(time.Second))
+	h.notifications.notify(eventChainStale, map[string]string{"chain": h.name}, "%s chain stale, no new block for %s", h.name, since.Round(time.Second))
+	return true
+}
+
+func (h *chainHealth) status() string {
+	if h.Healthy() {
+		return "healthy"
+	}
+	return "stale"
+}
+
+// checkStaleChains switches miners to the other chain if the chain they are mining on went stale
+func (a *Aggregator) checkStaleChains() {
+	primStale := a.prim.health.check()
+	if a.cfg.Secondary.SubmitURL == "" {
+		return
+	}
+	secStale := a.sec.health.check()
+
+	// the latest block of the healthy chain is served until the stale chain delivers a new block
+	switch {
+	case primStale && a.currentPrimChain.Get() && a.sec.health.Healthy():
+		if a.resume(a.sec) {
+			logChain.Warn("Switching miners", "chain", a.sec.name)
+		}
+	case secStale && !a.currentPrimChain.Get() && a.prim.health.Healthy():
+		if a.resume(a.prim) {
+			logChain.Warn("Switching miners", "chain", a.prim.name)
+		}
+	}
+}
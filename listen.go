@@ -0,0 +1,153 @@
+package aggregator
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// unixPrefix marks listener addresses of unix domain sockets, e.g. unix:/run/aggregator.sock
+const unixPrefix = "unix:"
+
+// ListenerConfig configures an additional address miners are served on
+type ListenerConfig struct {
+	Addr  string `mapstructure:"addr"`  // host:port, [ipv6]:port or unix:/path/to/socket
+	Chain string `mapstructure:"chain"` // primary or secondary, empty -> the chain the aggregator is currently on
+	Auth  string `mapstructure:"auth"`  // tokens or none, empty -> tokens if minerTokens are configured
+	TLS   bool   `mapstructure:"tls"`   // serve with tlsCertFile and tlsKeyFile
+	Stats bool   `mapstructure:"stats"` // answer requestType=getStats, e.g. on a localhost admin listener
+}
+
+// listener serves miners on an address with its own chain binding and authentication policy
+type listener struct {
+	addr    string
+	tls     bool
+	stats   bool
+	chain   *chain                    // nil -> miners follow the aggregator between the chains
+	tokens  map[string]*minerIdentity // nil -> no authentication
+	handler fasthttp.RequestHandler
+	ln      net.Listener
+	server  *fasthttp.Server
+}
+
+// newListener applies the policy of cfg, nothing is opened before Start
+func (a *Aggregator) newListener(cfg ListenerConfig) (*listener, error) {
+	l := &listener{addr: cfg.Addr, tls: cfg.TLS, stats: cfg.Stats}
+	switch cfg.Chain {
+	case "":
+	case "primary":
+		l.chain = a.prim
+	case "secondary":
+		if a.cfg.Secondary.SubmitURL == "" {
+			return nil, errors.New("chain secondary: no secondary chain configured")
+		}
+		l.chain = a.sec
+	default:
+		return nil, fmt.Errorf("unknown chain %q", cfg.Chain)
+	}
+	switch cfg.Auth {
+	case "":
+		l.tokens = a.tokens
+	case "tokens":
+		if a.tokens == nil {
+			return nil, errors.New("auth tokens: no minerTokens configured")
+		}
+		l.tokens = a.tokens
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown auth %q", cfg.Auth)
+	}
+	if cfg.TLS && a.cfg.TLSCertFile == "" {
+		return nil, errors.New("tls: no tlsCertFile configured")
+	}
+	l.handler = a.limiter.RateLimit(func(ctx *fasthttp.RequestCtx) {
+		a.requestHandler(ctx, l, nil)
+	})
+	if a.relays != nil {
+		l.handler = a.relayHandler(l, l.handler)
+	}
+	return l, nil
+}
+
+// chainName names the chain binding of the listener for logging
+func (l *listener) chainName() string {
+	if l.chain == nil {
+		return "any"
+	}
+	return l.chain.name
+}
+
+// authenticate looks up the token sent as X-Token header or token parameter, returns nil if authentication is disabled
+func (l *listener) authenticate(ctx *fasthttp.RequestCtx) (*minerIdentity, error) {
+	if l.tokens == nil {
+		return nil, nil
+	}
+	token := ctx.Request.Header.Peek("X-Token")
+	if len(token) == 0 {
+		token = ctx.FormValue("token")
+	}
+	id, exists := l.tokens[string(token)]
+	if !exists {
+		return nil, errUnauthorized
+	}
+	return id, nil
+}
+
+// serve opens the listener and serves miners until Stop, tlsConfig is only used by TLS listeners
+func (a *Aggregator) serve(l *listener, tlsConfig *tls.Config) error {
+	ln, err := listen(l.addr)
+	if err != nil {
+		return err
+	}
+	if l.tls {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	l.ln = ln
+	l.server = &fasthttp.Server{Handler: l.handler, ConnState: a.trackConn}
+	logMain.Info("Serving miners", "addr", ln.Addr(), "chain", l.chainName(), "auth", l.tokens != nil, "tls", l.tls)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := l.server.Serve(ln); err != nil {
+			logMain.Error("Serving miners failed", "addr", l.addr, "err", err)
+		}
+	}()
+	return nil
+}
+
+// listen opens addr, unix:path listens on a unix domain socket. IPv6 literals listen on IPv6,
+// other hosts on IPv4 only.
+func listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, unixPrefix); path != addr {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	network := "tcp4"
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			network = "tcp"
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// removeStaleSocket removes a socket file left behind by a crashed process, sockets still accepting
+// connections are kept
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket in use", path)
+	}
+	return os.Remove(path)
+}
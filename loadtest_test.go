@@ -0,0 +1,75 @@
+//go:build loadtest
+// +build loadtest
+
+package aggregator
+
+import (
+	"flag"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var loadMiners = flag.Int("miners", 200, "number of fake miners")
+var loadDuration = flag.Duration("duration", 10*time.Second, "load test duration")
+var loadMinRate = flag.Float64("minrate", 10000, "minimum getMiningInfo requests per second")
+
+// TestLoadGetMiningInfo lets fake miners poll the proxy over tcp as fast as they can:
+//
+//	go test -tags loadtest -run TestLoad -v -miners 500 -duration 30s
+func TestLoadGetMiningInfo(t *testing.T) {
+	a := setupBenchmark(t)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fasthttp.Server{Handler: a.Handler()}
+	go s.Serve(ln)
+	defer ln.Close()
+
+	var requests, failures uint64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *loadMiners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &fasthttp.HostClient{Addr: ln.Addr().String(), MaxConns: 1}
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(resp)
+			req.SetRequestURI("http://" + ln.Addr().String() + "/burst?requestType=getMiningInfo")
+			req.Header.Set("User-Agent", "fake-miner/1.0")
+			req.Header.Set("X-Minername", "rig"+strconv.Itoa(i))
+			req.Header.Set("X-Capacity", "10240")
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := c.Do(req, resp); err != nil || resp.StatusCode() != fasthttp.StatusOK {
+					atomic.AddUint64(&failures, 1)
+					continue
+				}
+				atomic.AddUint64(&requests, 1)
+			}
+		}(i)
+	}
+	start := time.Now()
+	time.Sleep(*loadDuration)
+	close(stop)
+	wg.Wait()
+
+	rate := float64(atomic.LoadUint64(&requests)) / time.Since(start).Seconds()
+	t.Logf("%d miners: %.0f req/s, %d failures, %d miners registered", *loadMiners, rate, failures, len(a.miners.clients))
+	if rate < *loadMinRate {
+		t.Fatalf("throughput %.0f req/s below %.0f req/s", rate, *loadMinRate)
+	}
+}
@@ -0,0 +1,279 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// log subsystems, each with its own verbosity
+var (
+	logMain      = newSubsystemLogger("main")
+	logSubmit    = newSubsystemLogger("submit")
+	logMiner     = newSubsystemLogger("miner")
+	logChain     = newSubsystemLogger("chain")
+	logWebsocket = newSubsystemLogger("websocket")
+	logRate      = newSubsystemLogger("ratelimit")
+	logTLS       = newSubsystemLogger("tls")
+	logNotify    = newSubsystemLogger("notify")
+)
+
+var logSubsystems = []string{"main", "submit", "miner", "chain", "websocket", "ratelimit", "tls", "notify"}
+
+// logOutput is the handler all subsystems write to, replaced once the config is loaded
+var logOutput atomic.Value // logHandler
+
+// logHandler boxes the output handler, atomic.Value needs a consistent type
+type logHandler struct {
+	slog.Handler
+}
+
+// logLevels maps subsystems to their minimum level, logDefaultLevel applies to the rest
+var logLevels atomic.Value // map[string]slog.Level
+var logDefaultLevel = new(slog.LevelVar)
+
+func init() {
+	SetLogHandler(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	logLevels.Store(map[string]slog.Level{})
+}
+
+// SetLogHandler directs all subsystems and the standard logger to h, logging is shared by all instances
+func SetLogHandler(h slog.Handler) {
+	logOutput.Store(logHandler{h})
+	log.SetFlags(0)
+	log.SetOutput(slogWriter{logMain})
+}
+
+// subsystemHandler filters by the level of its subsystem and tags records with it
+type subsystemHandler struct {
+	subsystem string
+	attrs     []slog.Attr
+}
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// Logger returns a logger of a subsystem, for programs embedding the aggregator
+func Logger(subsystem string) *slog.Logger {
+	return newSubsystemLogger(subsystem)
+}
+
+func subsystemLevel(subsystem string) slog.Level {
+	if level, ok := logLevels.Load().(map[string]slog.Level)[subsystem]; ok {
+		return level
+	}
+	return logDefaultLevel.Level()
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= subsystemLevel(h.subsystem)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.String("subsystem", h.subsystem))
+	r.AddAttrs(h.attrs...)
+	return logOutput.Load().(logHandler).Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{subsystem: h.subsystem, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+// WithGroup is not supported, attributes stay at the top level
+func (h *subsystemHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// slogWriter forwards the standard logger, used by libraries and fatal startup errors
+type slogWriter struct {
+	logger *slog.Logger
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// LoadLogLevels sets the default and the per subsystem levels from the config
+func LoadLogLevels(v *viper.Viper) error {
+	level, err := parseLogLevel(v.GetString("logLevel"))
+	if err != nil {
+		return fmt.Errorf("logLevel: %s", err)
+	}
+	levels := make(map[string]slog.Level)
+	for subsystem, s := range v.GetStringMapString("logLevels") {
+		known := false
+		for _, name := range logSubsystems {
+			known = known || name == subsystem
+		}
+		if !known {
+			return fmt.Errorf("logLevels: unknown subsystem %q", subsystem)
+		}
+		if levels[subsystem], err = parseLogLevel(s); err != nil {
+			return fmt.Errorf("logLevels.%s: %s", subsystem, err)
+		}
+	}
+	logDefaultLevel.Set(level)
+	logLevels.Store(levels)
+	return nil
+}
+
+// logFormatHandler creates the output handler of the configured format
+func logFormatHandler(v *viper.Viper, out io.Writer) (slog.Handler, error) {
+	// levels are filtered per subsystem, the output handler passes everything
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch v.GetString("logFormat") {
+	case "", "text", "logfmt":
+		// the text handler writes logfmt, logfmt is accepted as an alias
+		return slog.NewTextHandler(out, opts), nil
+	case "json":
+		return slog.NewJSONHandler(out, opts), nil
+	}
+	return nil, fmt.Errorf("logFormat: unknown format %q, use text or json", v.GetString("logFormat"))
+}
+
+// LoadLogging configures levels, format and output from the config
+func LoadLogging(v *viper.Viper) error {
+	if err := LoadLogLevels(v); err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	path := v.GetString("logFile")
+	if path == "" && v.GetBool("fileLogging") {
+		path = "log.txt"
+	}
+	if path != "" {
+		f, err := newRotatingFile(path, v.GetInt64("logMaxSize")<<20,
+			time.Duration(v.GetInt64("logMaxAge"))*time.Hour, v.GetInt("logMaxBackups"))
+		if err != nil {
+			return fmt.Errorf("logFile: %s", err)
+		}
+		out = io.MultiWriter(os.Stdout, f)
+	}
+	h, err := logFormatHandler(v, out)
+	if err != nil {
+		return err
+	}
+	SetLogHandler(h)
+	return nil
+}
+
+// backupTimeFormat suffixes the rotated log files
+const backupTimeFormat = "20060102-150405.000"
+
+// rotatingFile is a log file rotated by size and age, keeping a number of old files
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+
+	sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.size > 0 && (rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize ||
+		rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file with a timestamp suffix and removes the oldest backups
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	backup := rf.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(rf.path, backup); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if rf.backups <= 0 {
+		return nil
+	}
+	old, err := rf.listBackups()
+	if err != nil {
+		return err
+	}
+	for len(old) > rf.backups {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// listBackups returns the backups created by rotate, oldest first. Other files sharing the name as prefix
+// are not backups, e.g. aggregator.go next to the log file aggregator.
+func (rf *rotatingFile) listBackups() ([]string, error) {
+	dir, prefix := filepath.Dir(rf.path), filepath.Base(rf.path)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, name[len(prefix):]); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	// timestamps sort chronologically
+	sort.Strings(backups)
+	return backups, nil
+}
@@ -1,74 +1,284 @@
-package main
+package aggregator
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"log"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
-	cache "github.com/patrickmn/go-cache"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// miners not seen for minerRetention are removed from the registry
+	minerRetention = 24 * time.Hour
+	// miner names are client supplied, the names registered per ip are capped to bound the registry
+	maxNamesPerIP = 64
 )
 
 // ClientData stores all miner info
 type clientData struct {
-	Id       clientID `json:"id"`
-	Capacity int64    `json:"capacity"`
+	Id          clientID `json:"id"`
+	Capacity    int64    `json:"capacity"`
+	Software    string   `json:"software"`
+	FirstSeen   int64    `json:"firstSeen"`
+	LastSeen    int64    `json:"lastSeen"`
+	Online      bool     `json:"online"`
+	AccountIDs  []uint64 `json:"accountIds"`
+	Submissions uint64   `json:"submissions"`
+	LastHeight  uint64   `json:"lastHeight"`
+	LastDL      uint64   `json:"lastDeadline"`
+	estimator   capacityEstimator
 	sync.Mutex
 }
 
+// clientID is the stable identity of a miner, it does not change with the source port
 type clientID struct {
 	IP        string `json:"ip"`
-	Port      string `json:"port"`
 	MinerName string `json:"minerName"`
-	sync.Mutex
+	Relay     string `json:"relay,omitempty"` // child aggregator the miner is connected to, empty -> direct
 }
 
-var clients *cache.Cache
+// minerKey identifies a miner by ip, relay and miner name. Account ids are not part of it, they are only
+// known after the first submission and would split a miner polling getMiningInfo from its submissions.
+type minerKey struct {
+	ip    ipKey
+	relay string
+	name  string
+}
 
-// UpdateClient refreshed Miner data
-func UpdateClient(ip string, port string, minerName string, capacity int64) {
-	cid := clientID{IP: ip, Port: port, MinerName: minerName}
-	cd := clientData{Id: cid, Capacity: capacity}
-	key := hash(&cid)
-	clients.SetDefault(key, &cd)
+// clientRegistry holds all miners seen within minerRetention
+type clientRegistry struct {
+	clients       map[minerKey]*clientData
+	names         map[ipKey]int // registered miners per ip
+	maxCapacity   int64         // self reported capacities above are ignored, 0 -> no limit
+	notifications *notifier
+	sync.RWMutex
+}
+
+func newClientRegistry(maxCapacity int64, notifications *notifier) *clientRegistry {
+	return &clientRegistry{clients: make(map[minerKey]*clientData), names: make(map[ipKey]int), maxCapacity: maxCapacity, notifications: notifications}
+}
+
+// minerSoftware returns the User-Agent, X-Miner as fallback
+func minerSoftware(ctx *fasthttp.RequestCtx) []byte {
+	if ua := ctx.Request.Header.Peek("User-Agent"); len(ua) > 0 {
+		return ua
+	}
+	return ctx.Request.Header.Peek("X-Miner")
+}
+
+// clientName names a miner by its token, X-Minername or software in this order
+func clientName(ctx *fasthttp.RequestCtx, identity *minerIdentity) []byte {
+	if identity != nil && identity.name != "" {
+		return identity.nameKey
+	}
+	if name := ctx.Request.Header.Peek("X-Minername"); len(name) > 0 {
+		return name
+	}
+	return minerSoftware(ctx)
 }
 
-func hash(cd *clientID) string {
+// update refreshes miner data, known miners are updated in place
+func (r *clientRegistry) update(src minerSource, capacity int64) {
+	now := time.Now().Unix()
+	cd := r.get(src)
+	if cd == nil {
+		if cd = r.add(src, now); cd == nil {
+			return
+		}
+	}
 	cd.Lock()
-	req, _ := jsonx.MarshalToString(cd)
+	if capacity < 0 {
+		capacity = 0
+	}
+	if r.maxCapacity > 0 && capacity > r.maxCapacity {
+		if cd.Capacity != 0 || cd.LastSeen == cd.FirstSeen {
+			logMiner.Warn("Miner capacity ignored", "ip", cd.Id.IP, "miner", cd.Id.MinerName, "capacityGiB", capacity)
+		}
+		capacity = 0
+	}
+	cd.Capacity = capacity
+	// only miners coming back are notified, not those seen for the first time
+	cameBack := !cd.Online && cd.LastSeen > cd.FirstSeen
+	cd.LastSeen = now
+	if cd.Software != string(src.software) {
+		cd.Software = string(src.software)
+	}
+	wentOnline := !cd.Online
+	cd.Online = true
 	cd.Unlock()
-	hash := md5.Sum([]byte(req))
-	hashString := hex.EncodeToString(hash[:])
-	return hashString
+	if wentOnline {
+		logMiner.Info("Miner online", "ip", cd.Id.IP, "miner", cd.Id.MinerName, "relay", cd.Id.Relay, "software", string(src.software))
+	}
+	if cameBack {
+		r.notifications.notify(eventMinerOnline, cd.Id, "miner %s (%s) back online", cd.Id.MinerName, cd.Id.IP)
+	}
+}
+
+// submission records a deadline submitted by a miner for the primary or secondary chain
+func (r *clientRegistry) submission(src minerSource, round *minerRound, primary bool, baseTarget uint64, deadline uint64) {
+	cd := r.get(src)
+	if cd == nil {
+		if cd = r.add(src, time.Now().Unix()); cd == nil {
+			return
+		}
+	}
+	cd.Lock()
+	defer cd.Unlock()
+	cd.Submissions++
+	cd.LastHeight = round.Height
+	cd.LastDL = deadline
+	cd.estimator.add(primary, round.Height, baseTarget, deadline)
+	cd.addAccount(round.AccountID)
+}
+
+// addAccount inserts an account id keeping AccountIDs sorted, the caller holds the lock
+func (cd *clientData) addAccount(accountID uint64) {
+	i := sort.Search(len(cd.AccountIDs), func(i int) bool { return cd.AccountIDs[i] >= accountID })
+	if i == len(cd.AccountIDs) || cd.AccountIDs[i] != accountID {
+		cd.AccountIDs = append(cd.AccountIDs, 0)
+		copy(cd.AccountIDs[i+1:], cd.AccountIDs[i:])
+		cd.AccountIDs[i] = accountID
+	}
 }
 
-// DisplayMiners shows all miners
-func DisplayMiners() {
-	var count = 0
-	if clients.ItemCount() == 0 {
-		return
+func (r *clientRegistry) get(src minerSource) *clientData {
+	r.RLock()
+	defer r.RUnlock()
+	// string(src.name) does not allocate in a map index, getMiningInfo stays allocation free
+	return r.clients[minerKey{ip: newIPKey(src.ip), relay: src.relay, name: string(src.name)}]
+}
+
+// add registers a miner, nil if its ip already registered maxNamesPerIP miners
+func (r *clientRegistry) add(src minerSource, now int64) *clientData {
+	key := minerKey{ip: newIPKey(src.ip), relay: src.relay, name: string(src.name)}
+	r.Lock()
+	defer r.Unlock()
+	if cd, exists := r.clients[key]; exists {
+		return cd
+	}
+	if r.names[key.ip] >= maxNamesPerIP {
+		return nil
+	}
+	r.names[key.ip]++
+	cd := &clientData{
+		Id:        clientID{IP: src.ip.String(), MinerName: string(src.name), Relay: src.relay},
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	r.clients[key] = cd
+	return cd
+}
+
+// expire marks miners offline after minerCacheExpiration and forgets them after minerRetention
+func (r *clientRegistry) expire() {
+	now := time.Now()
+	offline := now.Add(-minerCacheExpiration).Unix()
+	forget := now.Add(-minerRetention).Unix()
+	r.Lock()
+	defer r.Unlock()
+	for key, cd := range r.clients {
+		cd.Lock()
+		if cd.Online && cd.LastSeen < offline {
+			cd.Online = false
+			logMiner.Info("Miner offline", "ip", cd.Id.IP, "miner", cd.Id.MinerName, "lastSeen", time.Unix(cd.LastSeen, 0).Format(time.RFC3339))
+			r.notifications.notify(eventMinerOffline, cd.Id, "miner %s (%s) offline, last seen %s", cd.Id.MinerName, cd.Id.IP,
+				time.Unix(cd.LastSeen, 0).Format(time.RFC3339))
+		}
+		if cd.LastSeen < forget {
+			delete(r.clients, key)
+			if r.names[key.ip]--; r.names[key.ip] == 0 {
+				delete(r.names, key.ip)
+			}
+		}
+		cd.Unlock()
 	}
-	miners := clients.Items()
-	for key, value := range miners {
-		miner := value.Object.(*clientData)
+}
+
+// each calls f for all miners
+func (r *clientRegistry) each(f func(cd *clientData)) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, cd := range r.clients {
+		f(cd)
+	}
+}
+
+// DisplayMiners logs all miners, the capacity and the state of the chains
+func (a *Aggregator) DisplayMiners() {
+	var online, offline int
+	var estimated int64
+	a.miners.each(func(miner *clientData) {
 		miner.Lock()
-		log.Println("Miner:", key, miner.Id.IP, miner.Id.MinerName, strconv.FormatFloat(float64(miner.Capacity)/1024.0, 'f', 5, 64), "TiB")
-		miner.Unlock()
-		count++
+		defer miner.Unlock()
+		if !miner.Online {
+			offline++
+			return
+		}
+		online++
+		estimate, rounds := miner.estimator.estimate()
+		estimated += estimate
+		logMiner.Info("Miner", "ip", miner.Id.IP, "miner", miner.Id.MinerName, "relay", miner.Id.Relay,
+			"software", miner.Software, "capacityTiB", formatTiB(miner.Capacity), "estimated", formatEstimate(estimate, rounds),
+			"accounts", miner.AccountIDs, "submissions", miner.Submissions,
+			"since", time.Unix(miner.FirstSeen, 0).Format(time.RFC3339))
+	})
+	logMiner.Info("Miners", "online", online, "offline", offline)
+	logMiner.Info("Total capacity", "capacityTiB", formatTiB(a.miners.totalCapacity()), "estimatedTiB", formatTiB(estimated))
+	a.displayRelays()
+	for _, c := range []*chain{a.prim, a.sec} {
+		if c.cfg.SubmitURL == "" {
+			continue
+		}
+		forged, rounds := c.round.stats()
+		logChain.Info("Chain", "chain", c.name, "status", c.health.status(),
+			"sinceLastBlock", c.health.sinceLastBlock().Round(time.Second), "forged", forged, "rounds", rounds)
+		a.displayStats(c)
 	}
-	log.Println("Total Capacity:", strconv.FormatFloat(float64(TotalCapacity())/1024.0, 'f', 5, 64), "TiB")
+	a.limiter.DisplayRejections()
+}
+
+func formatTiB(gib int64) string {
+	return strconv.FormatFloat(float64(gib)/1024.0, 'f', 5, 64)
 }
 
-// TotalCapacity outputs total capacity
-func TotalCapacity() int64 {
+func formatEstimate(gib int64, rounds int) string {
+	if rounds < minEstimationRounds {
+		return "n/a (" + strconv.Itoa(rounds) + " rounds)"
+	}
+	return formatTiB(gib) + " TiB (" + strconv.Itoa(rounds) + " rounds)"
+}
+
+// totalCapacity outputs total capacity of all online miners
+func (r *clientRegistry) totalCapacity() int64 {
 	var capa int64
-	miners := clients.Items()
-	for _, value := range miners {
-		miner := value.Object.(*clientData)
+	r.each(func(miner *clientData) {
+		miner.Lock()
+		if miner.Online {
+			capa += miner.Capacity
+		}
+		miner.Unlock()
+	})
+	return capa
+}
+
+// accountCapacity outputs the capacity of the online miners mining an account,
+// miners mining several accounts are assumed to split their capacity evenly
+func (r *clientRegistry) accountCapacity(accountID uint64) int64 {
+	var capa int64
+	r.each(func(miner *clientData) {
 		miner.Lock()
 		defer miner.Unlock()
-		capa += miner.Capacity
-	}
+		if !miner.Online {
+			return
+		}
+		for _, id := range miner.AccountIDs {
+			if id == accountID {
+				capa += miner.Capacity / int64(len(miner.AccountIDs))
+				return
+			}
+		}
+	})
 	return capa
 }
@@ -0,0 +1,168 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// notification events
+const (
+	eventMinerOffline = "miner_offline"
+	eventMinerOnline  = "miner_online"
+	eventCapacityDrop = "capacity_drop"
+	eventUpstreamDown = "upstream_down"
+	eventUpstreamUp   = "upstream_up"
+	eventChainStale   = "chain_stale"
+	eventLiarDetected = "liar_detected"
+)
+
+const (
+	notificationQueueSize = 256
+	webhookTimeout        = 10 * time.Second
+)
+
+type event struct {
+	Event   string      `json:"event"`
+	Message string      `json:"message"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Webhook is notified about events, Events empty -> all events
+type Webhook struct {
+	URL    string   `mapstructure:"url"`
+	Format string   `mapstructure:"format"` // json, telegram or discord
+	ChatID string   `mapstructure:"chatId"`
+	Events []string `mapstructure:"events"` // empty -> all events
+}
+
+type notifier struct {
+	hooks     []Webhook
+	queue     chan event
+	client    *fasthttp.Client
+	minerName string // names the aggregator in chat messages
+}
+
+func newNotifier(webhooks []Webhook, minerName string) (*notifier, error) {
+	hooks := append([]Webhook(nil), webhooks...)
+	for i, h := range hooks {
+		switch h.Format {
+		case "":
+			hooks[i].Format = "json"
+		case "json", "discord":
+		case "telegram":
+			if h.ChatID == "" {
+				return nil, fmt.Errorf("webhooks[%d]: telegram needs a chatId", i)
+			}
+		default:
+			return nil, fmt.Errorf("webhooks[%d]: unknown format %q", i, h.Format)
+		}
+	}
+	return &notifier{
+		hooks: hooks,
+		queue: make(chan event, notificationQueueSize),
+		client: &fasthttp.Client{
+			ReadTimeout:  webhookTimeout,
+			WriteTimeout: webhookTimeout,
+		},
+		minerName: minerName,
+	}, nil
+}
+
+// notify queues an event for all webhooks subscribed to it, events are dropped if the queue is full
+func (n *notifier) notify(name string, data interface{}, format string, args ...interface{}) {
+	if n == nil || len(n.hooks) == 0 {
+		return
+	}
+	e := event{Event: name, Message: fmt.Sprintf(format, args...), Time: time.Now(), Data: data}
+	select {
+	case n.queue <- e:
+	default:
+		logNotify.Warn("Notification dropped", "event", e.Event, "message", e.Message)
+	}
+}
+
+// run posts the queued events until stop is closed
+func (n *notifier) run(stop <-chan struct{}) {
+	for {
+		select {
+		case e := <-n.queue:
+			for _, h := range n.hooks {
+				if h.subscribed(e.Event) {
+					if err := n.post(h, e); err != nil {
+						logNotify.Warn("Webhook failed", "format", h.Format, "err", err)
+					}
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *Webhook) subscribed(name string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *notifier) post(h Webhook, e event) error {
+	var payload interface{}
+	text := "Aggregator " + n.minerName + ": " + e.Message
+	switch h.Format {
+	case "telegram":
+		payload = map[string]string{"chat_id": h.ChatID, "text": text}
+	case "discord":
+		payload = map[string]string{"content": text}
+	default:
+		payload = e
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(h.URL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := n.client.Do(req, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// checkCapacityDrop alerts if the total capacity fell more than CapacityDropAlert percent below its peak
+func (a *Aggregator) checkCapacityDrop() {
+	if a.cfg.CapacityDropAlert <= 0 {
+		return
+	}
+	capa := a.miners.totalCapacity()
+	peak := atomic.LoadInt64(&a.capacityPeak)
+	if capa > peak {
+		atomic.StoreInt64(&a.capacityPeak, capa)
+		return
+	}
+	if capa < peak*(100-a.cfg.CapacityDropAlert)/100 {
+		a.notifications.notify(eventCapacityDrop, map[string]int64{"capacity": capa, "previous": peak},
+			"total capacity dropped from %s TiB to %s TiB", formatTiB(peak), formatTiB(capa))
+		atomic.StoreInt64(&a.capacityPeak, capa)
+	}
+}
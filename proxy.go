@@ -0,0 +1,189 @@
+package aggregator
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialFunc opens a connection to addr, either directly or through a proxy
+type dialFunc func(network string, addr string) (net.Conn, error)
+
+var errSocksRejected = errors.New("socks5: connect rejected by proxy")
+
+// newProxyDial returns a dialFunc tunneling through an http (CONNECT) or socks5 proxy, a direct dialer if proxyURL is empty.
+// socks5 resolves host names locally, socks5h leaves resolving to the proxy.
+func newProxyDial(proxyURL string, dialer *net.Dialer) (dialFunc, error) {
+	if proxyURL == "" {
+		return dialer.Dial, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q: missing port", u.Host)
+	}
+	var tunnel func(conn net.Conn, u *url.URL, addr string) error
+	switch u.Scheme {
+	case "http":
+		tunnel = httpConnect
+	case "socks5":
+		tunnel = func(conn net.Conn, u *url.URL, addr string) error {
+			return socks5Connect(conn, u, addr, false)
+		}
+	case "socks5h":
+		tunnel = func(conn net.Conn, u *url.URL, addr string) error {
+			return socks5Connect(conn, u, addr, true)
+		}
+	default:
+		return nil, fmt.Errorf("proxy %q: unsupported scheme, use http, socks5 or socks5h", u.Host)
+	}
+	return func(network string, addr string) (net.Conn, error) {
+		conn, err := dialer.Dial(network, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if dialer.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(dialer.Timeout))
+		}
+		if err := tunnel(conn, u, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}, nil
+}
+
+// httpConnect opens a tunnel using the CONNECT method
+func httpConnect(conn net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// the upstream protocols are client first, nothing is buffered beyond the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect performs the socks5 handshake (RFC 1928/1929), host names are resolved by the proxy if remoteDNS is set
+func socks5Connect(conn net.Conn, u *url.URL, addr string, remoteDNS bool) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return err
+	}
+	if !remoteDNS && net.ParseIP(host) == nil {
+		ipAddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return err
+		}
+		host = ipAddr.IP.String()
+	}
+
+	// method negotiation, 0x00 no authentication, 0x02 username/password
+	method := byte(0x00)
+	if u.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 || buf[1] != method {
+		return errors.New("socks5: authentication method not accepted")
+	}
+	if method == 0x02 {
+		password, _ := u.User.Password()
+		user := u.User.Username()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	// connect
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply: version, status, reserved, address type, bound address, bound port
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return errSocksRejected
+	}
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return errors.New("socks5: unknown address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
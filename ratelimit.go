@@ -0,0 +1,301 @@
+package aggregator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+	"github.com/valyala/fasthttp"
+)
+
+// RateQuota limits the requests per second of the ips of a network, the submit quota falls back to the general one
+type RateQuota struct {
+	Network         string `mapstructure:"network"`
+	RateLimit       int    `mapstructure:"rateLimit"`
+	BurstRate       int    `mapstructure:"burstRate"`
+	SubmitRateLimit int    `mapstructure:"submitRateLimit"`
+	SubmitBurstRate int    `mapstructure:"submitBurstRate"`
+}
+
+// rateRule holds the limiters of a network, getMiningInfo and submitNonce have separate quotas
+type rateRule struct {
+	network     *net.IPNet
+	miningInfo  *gcraLimiter
+	submitNonce *gcraLimiter
+}
+
+// ipKey is an ip in 16 byte form, usable as map key without allocating
+type ipKey [net.IPv6len]byte
+
+func newIPKey(ip net.IP) (k ipKey) {
+	if len(ip) == net.IPv4len {
+		k[10], k[11] = 0xff, 0xff
+		copy(k[12:], ip)
+	} else {
+		copy(k[:], ip)
+	}
+	return
+}
+
+// gcraLimiter implements the generic cell rate algorithm, storing the theoretical arrival time per ip
+type gcraLimiter struct {
+	emission  int64 // nanos between two requests at the sustained rate
+	tolerance int64 // nanos a burst may run ahead
+	tat       map[ipKey]int64
+	sync.Mutex
+}
+
+func newGCRALimiter(rate int, burst int) *gcraLimiter {
+	emission := int64(time.Second) / int64(rate)
+	return &gcraLimiter{
+		emission:  emission,
+		tolerance: emission * int64(burst),
+		tat:       make(map[ipKey]int64),
+	}
+}
+
+// limit reports whether a request of key exceeds the quota
+func (g *gcraLimiter) limit(key ipKey, now int64) bool {
+	g.Lock()
+	defer g.Unlock()
+	tat, exists := g.tat[key]
+	if !exists || tat < now {
+		tat = now
+	}
+	if tat-now > g.tolerance {
+		return true
+	}
+	g.tat[key] = tat + g.emission
+	return false
+}
+
+// expire forgets ips that are back at their full burst
+func (g *gcraLimiter) expire(now int64) {
+	g.Lock()
+	defer g.Unlock()
+	for key, tat := range g.tat {
+		if tat < now {
+			delete(g.tat, key)
+		}
+	}
+}
+
+type rateLimiter struct {
+	trustedProxies []*net.IPNet
+	overrides      []*rateRule
+	defaultRule    *rateRule
+
+	// rejection counts, total and per ip
+	rejectedMiningInfo  uint64
+	rejectedSubmitNonce uint64
+	rejectedIPs         *cache.Cache
+}
+
+func newRateRule(c RateQuota) (*rateRule, error) {
+	if c.SubmitRateLimit == 0 {
+		c.SubmitRateLimit = c.RateLimit
+		c.SubmitBurstRate = c.BurstRate
+	}
+	if c.RateLimit <= 0 || c.SubmitRateLimit <= 0 {
+		return nil, fmt.Errorf("rate limit of %q must be positive", c.Network)
+	}
+	return &rateRule{
+		miningInfo:  newGCRALimiter(c.RateLimit, c.BurstRate),
+		submitNonce: newGCRALimiter(c.SubmitRateLimit, c.SubmitBurstRate),
+	}, nil
+}
+
+// parseNetwork accepts a CIDR or a single ip
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+func newRateLimiter(cfg Config) (*rateLimiter, error) {
+	rl := &rateLimiter{rejectedIPs: cache.New(defaultCacheExpiration, defaultCacheExpiration)}
+
+	var err error
+	rl.defaultRule, err = newRateRule(RateQuota{
+		Network:         "default",
+		RateLimit:       cfg.RateLimit,
+		BurstRate:       cfg.BurstRate,
+		SubmitRateLimit: cfg.SubmitRateLimit,
+		SubmitBurstRate: cfg.SubmitBurstRate,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range cfg.TrustedProxies {
+		network, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("trustedProxies: %s", err)
+		}
+		rl.trustedProxies = append(rl.trustedProxies, network)
+	}
+
+	for _, o := range cfg.RateLimitOverrides {
+		network, err := parseNetwork(o.Network)
+		if err != nil {
+			return nil, fmt.Errorf("rateLimitOverrides: %s", err)
+		}
+		rule, err := newRateRule(o)
+		if err != nil {
+			return nil, fmt.Errorf("rateLimitOverrides: %s", err)
+		}
+		rule.network = network
+		rl.overrides = append(rl.overrides, rule)
+	}
+
+	return rl, nil
+}
+
+// expire forgets the ips of all rules that are back at their full burst
+func (rl *rateLimiter) expire() {
+	now := time.Now().UnixNano()
+	for _, rule := range append(rl.overrides[:len(rl.overrides):len(rl.overrides)], rl.defaultRule) {
+		rule.miningInfo.expire(now)
+		rule.submitNonce.expire(now)
+	}
+}
+
+func (rl *rateLimiter) trusted(ip net.IP) bool {
+	for _, network := range rl.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the client behind trusted proxies, walking X-Forwarded-For from the right
+func (rl *rateLimiter) clientIP(remote net.IP, forwardedFor []byte) net.IP {
+	if len(forwardedFor) == 0 || !rl.trusted(remote) {
+		return remote
+	}
+	// walk the hops in place, splitting the header would allocate on every request
+	for end := len(forwardedFor); ; {
+		start := bytes.LastIndexByte(forwardedFor[:end], ',') + 1
+		ip := net.ParseIP(string(bytes.TrimSpace(forwardedFor[start:end])))
+		if ip == nil {
+			// garbage in the chain, stop at the last address we could verify
+			return remote
+		}
+		remote = ip
+		if !rl.trusted(ip) || start == 0 {
+			return remote
+		}
+		end = start - 1
+	}
+}
+
+// remoteIP returns the client ip of a request, resolved behind trusted proxies
+func (rl *rateLimiter) remoteIP(ctx *fasthttp.RequestCtx) net.IP {
+	return rl.clientIP(ctx.RemoteIP(), ctx.Request.Header.Peek("X-Forwarded-For"))
+}
+
+// rule returns the first matching override or the default rule
+func (rl *rateLimiter) rule(ip net.IP) *rateRule {
+	for _, rule := range rl.overrides {
+		if rule.network.Contains(ip) {
+			return rule
+		}
+	}
+	return rl.defaultRule
+}
+
+// allow counts a request of ip and reports if it is within its quota
+func (rl *rateLimiter) allow(ip net.IP, submit bool) bool {
+	rule := rl.rule(ip)
+	key := newIPKey(ip)
+	now := time.Now().UnixNano()
+	var limited bool
+	if submit {
+		limited = rule.submitNonce.limit(key, now)
+	} else {
+		limited = rule.miningInfo.limit(key, now)
+	}
+	if limited {
+		if submit {
+			atomic.AddUint64(&rl.rejectedSubmitNonce, 1)
+		} else {
+			atomic.AddUint64(&rl.rejectedMiningInfo, 1)
+		}
+		ipString := ip.String()
+		if rl.rejectedIPs.Add(ipString, uint64(1), cache.DefaultExpiration) != nil {
+			rl.rejectedIPs.IncrementUint64(ipString, 1)
+		}
+	}
+	return !limited
+}
+
+// RateLimit wraps a handler, limited requests are answered with 429
+func (rl *rateLimiter) RateLimit(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ip := rl.remoteIP(ctx)
+		if !rl.allow(ip, string(ctx.FormValue("requestType")) == "submitNonce") {
+			ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			ctx.Write(formatJSONError(7, "rate limit exceeded"))
+			return
+		}
+		h(ctx)
+	}
+}
+
+// rejectionReport holds the requests rejected since the start, per ip for the last defaultCacheExpiration
+type rejectionReport struct {
+	GetMiningInfo uint64         `json:"getMiningInfo"`
+	SubmitNonce   uint64         `json:"submitNonce"`
+	IPs           []ipRejections `json:"ips"`
+}
+
+type ipRejections struct {
+	IP       string `json:"ip"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// rejections reports the rejection counts, ips sorted by rejections
+func (rl *rateLimiter) rejections() rejectionReport {
+	r := rejectionReport{
+		GetMiningInfo: atomic.LoadUint64(&rl.rejectedMiningInfo),
+		SubmitNonce:   atomic.LoadUint64(&rl.rejectedSubmitNonce),
+		IPs:           []ipRejections{},
+	}
+	for ip, item := range rl.rejectedIPs.Items() {
+		r.IPs = append(r.IPs, ipRejections{IP: ip, Rejected: item.Object.(uint64)})
+	}
+	sort.Slice(r.IPs, func(i, j int) bool {
+		if r.IPs[i].Rejected != r.IPs[j].Rejected {
+			return r.IPs[i].Rejected > r.IPs[j].Rejected
+		}
+		return r.IPs[i].IP < r.IPs[j].IP
+	})
+	return r
+}
+
+// DisplayRejections shows the rejection counts
+func (rl *rateLimiter) DisplayRejections() {
+	r := rl.rejections()
+	logRate.Info("Rate limiter rejected", "getMiningInfo", r.GetMiningInfo, "submitNonce", r.SubmitNonce)
+	for _, ip := range r.IPs {
+		logRate.Info("Rate limited", "ip", ip.IP, "rejected", ip.Rejected)
+	}
+}
@@ -0,0 +1,271 @@
+package aggregator
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// child aggregators announce their miners every relayAnnounceInterval, well within minerCacheExpiration
+const relayAnnounceInterval = 20 * time.Second
+
+var errUnknownRelay = errors.New("unknown relay or invalid relay token")
+
+// Relay is a child aggregator allowed to relay its miners. Network restricts the ips the relay connects from,
+// the rate limits apply to the relay as a whole, rateLimit 0 -> not limited.
+type Relay struct {
+	Name      string `mapstructure:"name"`
+	Token     string `mapstructure:"token"`
+	MaxMiners int    `mapstructure:"maxMiners"` // announced miners accepted, 0 -> no limit
+	RateQuota `mapstructure:",squash"`
+}
+
+// minerSource identifies the miner behind a request, relayed miners are identified by their relay
+type minerSource struct {
+	ip       net.IP
+	name     []byte
+	software []byte
+	relay    string // empty -> connected directly
+}
+
+// submitKey keys the submissions of a miner ip, minersPerIP applies to the miners behind a relay as well
+func (src minerSource) submitKey() string {
+	if src.relay == "" {
+		return src.ip.String()
+	}
+	return src.relay + "/" + src.ip.String()
+}
+
+// relayedMiner is a miner announced by a child aggregator
+type relayedMiner struct {
+	IP         string   `json:"ip"`
+	MinerName  string   `json:"minerName"`
+	Software   string   `json:"software"`
+	Capacity   int64    `json:"capacity"`
+	AccountIDs []uint64 `json:"accountIds"`
+}
+
+type relayAnnouncement struct {
+	Miners []relayedMiner `json:"miners"`
+}
+
+// relay is the state of a child aggregator seen by its parent
+type relay struct {
+	name      string
+	token     []byte
+	network   *net.IPNet // nil -> any
+	maxMiners int
+	limits    *rateRule // nil -> not rate limited
+
+	lastSeen    int64        // unix, atomic
+	addr        atomic.Value // string, ip the relay last connected from
+	miners      int64        // announced, atomic
+	capacity    int64        // GiB announced, atomic
+	submissions uint64       // atomic
+}
+
+func newRelays(relays []Relay) (map[string]*relay, error) {
+	if len(relays) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]*relay, len(relays))
+	for i, c := range relays {
+		if c.Name == "" || c.Token == "" {
+			return nil, fmt.Errorf("relays[%d]: name and token required", i)
+		}
+		if _, exists := m[c.Name]; exists {
+			return nil, fmt.Errorf("relays[%d]: duplicate name %q", i, c.Name)
+		}
+		r := &relay{name: c.Name, token: []byte(c.Token), maxMiners: c.MaxMiners}
+		if c.Network != "" {
+			network, err := parseNetwork(c.Network)
+			if err != nil {
+				return nil, fmt.Errorf("relays[%d]: %s", i, err)
+			}
+			r.network = network
+		}
+		if c.RateLimit > 0 {
+			rule, err := newRateRule(c.RateQuota)
+			if err != nil {
+				return nil, fmt.Errorf("relays[%d]: %s", i, err)
+			}
+			r.limits = rule
+		}
+		r.addr.Store("")
+		m[c.Name] = r
+	}
+	return m, nil
+}
+
+// relayHandler serves child aggregators announcing themselves with X-Relay, bypassing miner authentication
+// and the rate limits of miners. All other requests go to next.
+func (a *Aggregator) relayHandler(l *listener, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		name := ctx.Request.Header.Peek("X-Relay")
+		if len(name) == 0 {
+			next(ctx)
+			return
+		}
+		r, exists := a.relays[string(name)]
+		if !exists || !r.authenticate(ctx) {
+			logMain.Warn("Relay rejected", "relay", string(name), "ip", ctx.RemoteIP())
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			ctx.Write(formatJSONError(5, errUnknownRelay.Error()))
+			return
+		}
+		if !r.allow(ctx) {
+			ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			ctx.Write(formatJSONError(7, "rate limit exceeded"))
+			return
+		}
+		atomic.StoreInt64(&r.lastSeen, time.Now().Unix())
+		if ip := ctx.RemoteIP().String(); ip != r.addr.Load().(string) {
+			logMain.Info("Relay connected", "relay", r.name, "ip", ip)
+			r.addr.Store(ip)
+		}
+		a.requestHandler(ctx, l, r)
+	}
+}
+
+func (r *relay) authenticate(ctx *fasthttp.RequestCtx) bool {
+	if r.network != nil && !r.network.Contains(ctx.RemoteIP()) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(ctx.Request.Header.Peek("X-Relay-Token"), r.token) == 1
+}
+
+// allow counts a request of the relay against its own limits
+func (r *relay) allow(ctx *fasthttp.RequestCtx) bool {
+	if r.limits == nil {
+		return true
+	}
+	key := newIPKey(ctx.RemoteIP())
+	now := time.Now().UnixNano()
+	if string(ctx.FormValue("requestType")) == "submitNonce" {
+		return !r.limits.submitNonce.limit(key, now)
+	}
+	return !r.limits.miningInfo.limit(key, now)
+}
+
+// source returns the miner a relay forwards a submission for, the relay itself if the miner is not named
+func (r *relay) source(ctx *fasthttp.RequestCtx) minerSource {
+	ip := net.ParseIP(string(ctx.Request.Header.Peek("X-Relay-Miner-IP")))
+	if ip == nil {
+		ip = ctx.RemoteIP()
+	}
+	return minerSource{
+		ip:       ip,
+		name:     ctx.Request.Header.Peek("X-Relay-Miner-Name"),
+		software: ctx.Request.Header.Peek("X-Relay-Miner-Software"),
+		relay:    r.name,
+	}
+}
+
+// announced registers the miners a relay announced
+func (a *Aggregator) announced(ctx *fasthttp.RequestCtx, r *relay) {
+	var ann relayAnnouncement
+	if err := jsonx.Unmarshal(ctx.PostBody(), &ann); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.Write(formatJSONError(1, "invalid announcement: "+err.Error()))
+		return
+	}
+	if r.maxMiners > 0 && len(ann.Miners) > r.maxMiners {
+		logMain.Warn("Relay exceeds maxMiners", "relay", r.name, "miners", len(ann.Miners), "maxMiners", r.maxMiners)
+		ann.Miners = ann.Miners[:r.maxMiners]
+	}
+	var capacity int64
+	for _, m := range ann.Miners {
+		src := minerSource{ip: net.ParseIP(m.IP), name: []byte(m.MinerName), software: []byte(m.Software), relay: r.name}
+		if src.ip == nil {
+			continue
+		}
+		a.miners.update(src, m.Capacity)
+		if cd := a.miners.get(src); cd != nil {
+			cd.Lock()
+			capacity += cd.Capacity
+			for _, id := range m.AccountIDs {
+				cd.addAccount(id)
+			}
+			cd.Unlock()
+		}
+	}
+	atomic.StoreInt64(&r.miners, int64(len(ann.Miners)))
+	atomic.StoreInt64(&r.capacity, capacity)
+	ctx.Write([]byte("{\"result\":\"success\",\"miners\":" + strconv.Itoa(len(ann.Miners)) + "}"))
+}
+
+// displayRelays logs the child aggregators
+func (a *Aggregator) displayRelays() {
+	for _, r := range a.relays {
+		lastSeen := atomic.LoadInt64(&r.lastSeen)
+		online := lastSeen > time.Now().Add(-minerCacheExpiration).Unix()
+		logMiner.Info("Relay", "relay", r.name, "ip", r.addr.Load().(string), "online", online,
+			"miners", atomic.LoadInt64(&r.miners), "capacityTiB", formatTiB(atomic.LoadInt64(&r.capacity)),
+			"submissions", atomic.LoadUint64(&r.submissions), "lastSeen", time.Unix(lastSeen, 0).Format(time.RFC3339))
+	}
+}
+
+// announce reports the online miners to the parent aggregators of relaying chains
+func (a *Aggregator) announce() {
+	if !a.prim.cfg.Relay && !a.sec.cfg.Relay {
+		return
+	}
+	ann := relayAnnouncement{Miners: []relayedMiner{}}
+	a.miners.each(func(cd *clientData) {
+		cd.Lock()
+		defer cd.Unlock()
+		if cd.Online {
+			ann.Miners = append(ann.Miners, relayedMiner{IP: cd.Id.IP, MinerName: cd.Id.MinerName, Software: cd.Software,
+				Capacity: cd.Capacity, AccountIDs: append([]uint64(nil), cd.AccountIDs...)})
+		}
+	})
+	body, err := jsonx.Marshal(ann)
+	if err != nil {
+		logMain.Error("Relay announcement failed", "err", err)
+		return
+	}
+	for _, c := range []*chain{a.prim, a.sec} {
+		if !c.cfg.Relay {
+			continue
+		}
+		if err := c.upstream.announce(body); err != nil {
+			logMain.Warn("Relay announcement failed", "chain", c.name, "err", err)
+		}
+	}
+}
+
+// setRelayHeaders announces this aggregator as relay to a parent aggregator
+func (u *upstream) setRelayHeaders(req *fasthttp.Request) {
+	if u.relayName == "" {
+		return
+	}
+	req.Header.Set("X-Relay", u.relayName)
+	req.Header.Set("X-Relay-Token", u.relayToken)
+}
+
+// announce posts the miners of this aggregator to the parent
+func (u *upstream) announce(body []byte) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.URI().Update(u.url + "/burst?requestType=announceRelay")
+	req.Header.Set("User-Agent", "Aggregator/"+Version)
+	u.setRelayHeaders(req)
+	req.Header.SetMethodBytes([]byte("POST"))
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := u.do(req, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode(), resp.Body())
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package aggregator
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// statistics windows are limited to about a month of blocks
+const maxStatsWindow = 10000
+
+// defaultStatsWindows are the statistics windows in rounds if none are configured
+var defaultStatsWindows = []int{10, 360}
+
+// roundRecord is the activity of a miner or an account in one round
+type roundRecord struct {
+	submissions int
+	late        int
+	best        uint64  // seconds, valid if submissions > 0
+	quality     float64 // base target * best deadline, the raw deadline independent of the difficulty
+}
+
+func (r *roundRecord) add(baseTarget uint64, deadline uint64) {
+	if r.submissions == 0 || deadline < r.best {
+		r.best = deadline
+		r.quality = float64(baseTarget) * float64(deadline)
+	}
+	r.submissions++
+}
+
+// subjectStats is the round history of a miner or an account
+type subjectStats struct {
+	current roundRecord
+	history []roundRecord // finished rounds, ring buffer of the largest window
+	next    int
+	idle    int // finished rounds since the last submission
+}
+
+func (s *subjectStats) push(r roundRecord, max int) {
+	if len(s.history) < max {
+		s.history = append(s.history, r)
+		s.next = len(s.history) % max
+		return
+	}
+	s.history[s.next] = r
+	s.next = (s.next + 1) % max
+}
+
+// recent returns the i-th most recent finished round
+func (s *subjectStats) recent(i int) *roundRecord {
+	n := len(s.history)
+	return &s.history[(s.next-1-i+2*n)%n]
+}
+
+// windowStats summarizes the last finished rounds of a miner or an account
+type windowStats struct {
+	Rounds              int     `json:"rounds"`
+	Submissions         int     `json:"submissions"`
+	SubmissionsPerRound float64 `json:"submissionsPerRound"`
+	BestDeadline        uint64  `json:"bestDeadline"`
+	AvgQuality          float64 `json:"avgQuality"` // mean base target * best deadline of the rounds with submissions, lower is better
+	MissedRounds        int     `json:"missedRounds"`
+	LateSubmissions     int     `json:"lateSubmissions"`
+}
+
+func (s *subjectStats) window(rounds int) windowStats {
+	var w windowStats
+	var quality float64
+	for i := 0; i < rounds && i < len(s.history); i++ {
+		r := s.recent(i)
+		w.Rounds++
+		w.LateSubmissions += r.late
+		if r.submissions == 0 {
+			w.MissedRounds++
+			continue
+		}
+		if w.Submissions == 0 || r.best < w.BestDeadline {
+			w.BestDeadline = r.best
+		}
+		w.Submissions += r.submissions
+		quality += r.quality
+	}
+	if w.Rounds > 0 {
+		w.SubmissionsPerRound = float64(w.Submissions) / float64(w.Rounds)
+	}
+	if mined := w.Rounds - w.MissedRounds; mined > 0 {
+		w.AvgQuality = quality / float64(mined)
+	}
+	return w
+}
+
+type minerStats struct {
+	id clientID
+	subjectStats
+}
+
+// deadlineStats keeps the round history of the miners and accounts of a chain. Subjects are forgotten
+// once they didn't submit for the largest window.
+type deadlineStats struct {
+	windows []int // rounds, ascending
+
+	sync.Mutex
+	height   uint64 // current round
+	miners   map[minerKey]*minerStats
+	accounts map[uint64]*subjectStats
+}
+
+func newDeadlineStats(windows []int) *deadlineStats {
+	if len(windows) == 0 {
+		windows = defaultStatsWindows
+	}
+	sorted := append([]int(nil), windows...)
+	sort.Ints(sorted)
+	unique := sorted[:0]
+	for _, w := range sorted {
+		if w > 0 && (len(unique) == 0 || unique[len(unique)-1] != w) {
+			unique = append(unique, w)
+		}
+	}
+	if len(unique) == 0 {
+		unique = defaultStatsWindows
+	}
+	return &deadlineStats{
+		windows:  unique,
+		miners:   make(map[minerKey]*minerStats),
+		accounts: make(map[uint64]*subjectStats),
+	}
+}
+
+func (d *deadlineStats) max() int {
+	return d.windows[len(d.windows)-1]
+}
+
+// subjects returns the stats of the miner and the account, the caller holds the lock
+func (d *deadlineStats) subjects(src minerSource, accountID uint64) (*minerStats, *subjectStats) {
+	key := minerKey{ip: newIPKey(src.ip), relay: src.relay, name: string(src.name)}
+	m, exists := d.miners[key]
+	if !exists {
+		m = &minerStats{id: clientID{IP: src.ip.String(), MinerName: string(src.name), Relay: src.relay}}
+		d.miners[key] = m
+	}
+	acc, exists := d.accounts[accountID]
+	if !exists {
+		acc = &subjectStats{}
+		d.accounts[accountID] = acc
+	}
+	return m, acc
+}
+
+// submitted records a deadline in seconds, submissions for another than the current round count as late
+func (d *deadlineStats) submitted(src minerSource, accountID uint64, height uint64, baseTarget uint64, deadline uint64) {
+	d.Lock()
+	defer d.Unlock()
+	m, acc := d.subjects(src, accountID)
+	if height != d.height {
+		m.current.late++
+		acc.current.late++
+		return
+	}
+	m.current.add(baseTarget, deadline)
+	acc.current.add(baseTarget, deadline)
+}
+
+// late records a submission rejected as out-dated
+func (d *deadlineStats) late(src minerSource, accountID uint64) {
+	d.Lock()
+	defer d.Unlock()
+	m, acc := d.subjects(src, accountID)
+	m.current.late++
+	acc.current.late++
+}
+
+// newBlock finishes the current round of all miners and accounts
+func (d *deadlineStats) newBlock(height uint64) {
+	d.Lock()
+	defer d.Unlock()
+	if height == d.height {
+		return
+	}
+	finish := d.height != 0
+	d.height = height
+	if !finish {
+		return
+	}
+	max := d.max()
+	closeRound := func(s *subjectStats) bool {
+		if s.current.submissions == 0 && s.current.late == 0 {
+			s.idle++
+		} else {
+			s.idle = 0
+		}
+		s.push(s.current, max)
+		s.current = roundRecord{}
+		return s.idle >= max
+	}
+	for key, m := range d.miners {
+		if closeRound(&m.subjectStats) {
+			delete(d.miners, key)
+		}
+	}
+	for id, acc := range d.accounts {
+		if closeRound(acc) {
+			delete(d.accounts, id)
+		}
+	}
+}
+
+type minerReport struct {
+	clientID
+	Windows []windowStats `json:"windows"`
+}
+
+type accountReport struct {
+	AccountID uint64        `json:"accountId"`
+	Windows   []windowStats `json:"windows"`
+}
+
+type chainStatsReport struct {
+	Chain    string          `json:"chain"`
+	Height   uint64          `json:"height"`
+	Windows  []int           `json:"windows"`
+	Miners   []minerReport   `json:"miners"`
+	Accounts []accountReport `json:"accounts"`
+}
+
+// report summarizes all windows, miners sorted by ip and name, accounts by id
+func (d *deadlineStats) report(chain string) chainStatsReport {
+	d.Lock()
+	defer d.Unlock()
+	r := chainStatsReport{Chain: chain, Height: d.height, Windows: d.windows,
+		Miners: make([]minerReport, 0, len(d.miners)), Accounts: make([]accountReport, 0, len(d.accounts))}
+	windows := func(s *subjectStats) []windowStats {
+		ws := make([]windowStats, len(d.windows))
+		for i, w := range d.windows {
+			ws[i] = s.window(w)
+		}
+		return ws
+	}
+	for _, m := range d.miners {
+		r.Miners = append(r.Miners, minerReport{clientID: m.id, Windows: windows(&m.subjectStats)})
+	}
+	for id, acc := range d.accounts {
+		r.Accounts = append(r.Accounts, accountReport{AccountID: id, Windows: windows(acc)})
+	}
+	sort.Slice(r.Miners, func(i, j int) bool {
+		a, b := r.Miners[i].clientID, r.Miners[j].clientID
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+		if a.MinerName != b.MinerName {
+			return a.MinerName < b.MinerName
+		}
+		return a.Relay < b.Relay
+	})
+	sort.Slice(r.Accounts, func(i, j int) bool { return r.Accounts[i].AccountID < r.Accounts[j].AccountID })
+	return r
+}
+
+// lateChain guesses the chain an out-dated round was mined for, the chain with the nearest newer block
+func (a *Aggregator) lateChain(round *minerRound, bound *chain) *chain {
+	if bound != nil {
+		return bound
+	}
+	late := a.prim
+	distance := ^uint64(0)
+	for _, c := range []*chain{a.prim, a.sec} {
+		mi, _ := c.latest.Load().(*miningInfo)
+		if mi == nil || uint64(mi.Height) <= round.Height {
+			continue
+		}
+		if d := uint64(mi.Height) - round.Height; d < distance {
+			late, distance = c, d
+		}
+	}
+	return late
+}
+
+// writeStats answers getStats with the statistics of all chains and the rate limiter rejections
+func (a *Aggregator) writeStats(ctx *fasthttp.RequestCtx) {
+	var stats struct {
+		Chains    []chainStatsReport `json:"chains"`
+		RateLimit rejectionReport    `json:"rateLimit"`
+	}
+	stats.RateLimit = a.limiter.rejections()
+	for _, c := range []*chain{a.prim, a.sec} {
+		if c.cfg.SubmitURL != "" {
+			stats.Chains = append(stats.Chains, c.stats.report(c.name))
+		}
+	}
+	body, err := jsonx.Marshal(stats)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.Write(formatJSONError(1, err.Error()))
+		return
+	}
+	ctx.Write(body)
+}
+
+// windowAttrs groups the windows of a miner or an account for logging, e.g. last10.missed=2
+func windowAttrs(windows []int, ws []windowStats) []interface{} {
+	attrs := make([]interface{}, 0, len(ws))
+	for i, w := range ws {
+		attrs = append(attrs, slog.Group("last"+strconv.Itoa(windows[i]),
+			"rounds", w.Rounds, "submissions", w.Submissions, "bestDeadline", w.BestDeadline,
+			"avgQuality", strconv.FormatFloat(w.AvgQuality, 'f', 0, 64), "missed", w.MissedRounds, "late", w.LateSubmissions))
+	}
+	return attrs
+}
+
+// displayStats logs the deadline statistics of a chain
+func (a *Aggregator) displayStats(c *chain) {
+	r := c.stats.report(c.name)
+	for _, m := range r.Miners {
+		logMiner.Info("Miner stats", append([]interface{}{"chain", c.name, "ip", m.IP, "miner", m.MinerName, "relay", m.Relay},
+			windowAttrs(r.Windows, m.Windows)...)...)
+	}
+	for _, acc := range r.Accounts {
+		logMiner.Info("Account stats", append([]interface{}{"chain", c.name, "accountId", acc.AccountID},
+			windowAttrs(r.Windows, acc.Windows)...)...)
+	}
+}
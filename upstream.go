@@ -0,0 +1,108 @@
+package aggregator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultDialTimeout  = 5 * time.Second
+	defaultReadTimeout  = 10 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	maxIdleConnDuration = 30 * time.Second
+)
+
+// upstream is a pool or wallet with its own connection pool
+type upstream struct {
+	url    string
+	client *fasthttp.Client
+
+	// capacity reporting
+	capacity           int64 // GiB, overrides the sum of the miners if set
+	capacityPerAccount bool
+	miners             *clientRegistry
+
+	// announced to a parent aggregator, empty -> not relaying
+	relayName  string
+	relayToken string
+}
+
+// orDefault returns def for unset timeouts
+func orDefault(d time.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// chainDial returns the dialer of a chain, going through its proxy if one is configured
+func chainDial(cfg ChainConfig) (dialFunc, error) {
+	dialer := &net.Dialer{
+		Timeout:   orDefault(cfg.DialTimeout, defaultDialTimeout),
+		KeepAlive: maxIdleConnDuration,
+	}
+	dial, err := newProxyDial(cfg.Proxy, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %s", err)
+	}
+	return dial, nil
+}
+
+// newUpstream creates the client of a chain, connections are kept alive and redialed
+// after maxIdleConnDuration, resolving the host again on every dial
+func newUpstream(url string, cfg ChainConfig, miners *clientRegistry) (*upstream, error) {
+	dial, err := chainDial(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{
+		url:                url,
+		capacity:           cfg.Capacity,
+		capacityPerAccount: cfg.CapacityPerAccount,
+		miners:             miners,
+		client: &fasthttp.Client{
+			NoDefaultUserAgentHeader: true,
+			Dial:                     func(addr string) (net.Conn, error) { return dial("tcp", addr) },
+			MaxIdleConnDuration:      maxIdleConnDuration,
+			ReadTimeout:              orDefault(cfg.ReadTimeout, defaultReadTimeout),
+			WriteTimeout:             orDefault(cfg.WriteTimeout, defaultWriteTimeout),
+		},
+	}, nil
+}
+
+// do sends the request, the caller releases req and resp
+func (u *upstream) do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	return u.client.Do(req, resp)
+}
+
+func (u *upstream) getMiningInfo(mi *miningInfo) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.URI().Update(u.url + "/burst?requestType=getMiningInfo")
+	req.Header.Set("User-Agent", "Aggregator/"+Version)
+	req.Header.Set("X-Miner", "Aggregator/"+Version)
+	req.Header.Set("X-Capacity", strconv.FormatInt(u.reportedCapacity(0), 10))
+	u.setRelayHeaders(req)
+	req.Header.SetMethodBytes([]byte("GET"))
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := u.do(req, resp); err != nil {
+		return err
+	}
+	return jsonx.Unmarshal(resp.Body(), mi)
+}
+
+// reportedCapacity is the capacity announced to the pool, for a single account if per account reporting is enabled
+func (u *upstream) reportedCapacity(accountID uint64) int64 {
+	if u.capacity > 0 {
+		return u.capacity
+	}
+	if u.capacityPerAccount && accountID != 0 {
+		return u.miners.accountCapacity(accountID)
+	}
+	return u.miners.totalCapacity()
+}
@@ -0,0 +1,414 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// check validates the effective value of a config key
+type check func(value interface{}) error
+
+// configSchema lists every known config key with its check
+var configSchema = map[string]check{
+	"listenAddr":           listenAddress,
+	"listeners":            isList,
+	"scanTime":             intRange(0, 3600),
+	"displayMiners":        isBool,
+	"statsWindows":         isList,
+	"tlsCertFile":          isString,
+	"tlsKeyFile":           isString,
+	"tlsClientCAFile":      isString,
+	"minerName":            isString,
+	"minerAlias":           isString,
+	"websocketBatchWindow": intRange(0, 10000),
+	"logLevel":             oneOf("debug", "info", "warn", "error"),
+	"logLevels":            isMap,
+	"logFormat":            oneOf("text", "logfmt", "json"),
+	"logFile":              isString,
+	"logMaxSize":           intRange(0, math.MaxInt32),
+	"logMaxAge":            intRange(0, math.MaxInt32),
+	"logMaxBackups":        intRange(0, math.MaxInt32),
+	"fileLogging":          isBool,
+	"webhooks":             isList,
+	"capacityDropAlert":    intRange(0, 100),
+	"minersPerIP":          intRange(1, math.MaxInt32),
+	"maxMinerCapacity":     intRange(0, math.MaxInt64),
+	"lieDetector":          isBool,
+	"rateLimit":            intRange(1, math.MaxInt32),
+	"burstRate":            intRange(0, math.MaxInt32),
+	"submitRateLimit":      intRange(0, math.MaxInt32),
+	"submitBurstRate":      intRange(0, math.MaxInt32),
+	"trustedProxies":       isList,
+	"rateLimitOverrides":   isList,
+	"minerTokens":          isList,
+	"relayName":            isString,
+	"relayToken":           isString,
+	"relays":               isList,
+}
+
+// requiredKeys have no usable default and must be set
+var requiredKeys = []string{"listenAddr", "primarySubmitURL", "minersPerIP", "rateLimit"}
+
+func init() {
+	for _, prefix := range []string{"primary", "secondary"} {
+		configSchema[prefix+"SubmitURL"] = urlScheme(prefix == "secondary", "http", "https", "ws", "wss")
+		configSchema[prefix+"TargetDeadline"] = intRange(0, math.MaxInt64)
+		configSchema[prefix+"Passphrase"] = isString
+		configSchema[prefix+"IpForwarding"] = isBool
+		configSchema[prefix+"IgnoreWorseDeadlines"] = isBool
+		configSchema[prefix+"AccountKey"] = isString
+		configSchema[prefix+"AllowedAccounts"] = isList
+		configSchema[prefix+"DeniedAccounts"] = isList
+		configSchema[prefix+"Proxy"] = urlScheme(true, "http", "socks5", "socks5h")
+		configSchema[prefix+"DialTimeout"] = floatRange(0, 3600)
+		configSchema[prefix+"ReadTimeout"] = floatRange(0, 3600)
+		configSchema[prefix+"WriteTimeout"] = floatRange(0, 3600)
+		configSchema[prefix+"Capacity"] = intRange(0, math.MaxInt64)
+		configSchema[prefix+"CapacityPerAccount"] = isBool
+		configSchema[prefix+"BlockTime"] = intRange(1, 86400)
+		configSchema[prefix+"StaleFactor"] = intRange(0, 1000)
+		configSchema[prefix+"WalletURL"] = urlScheme(true, "http", "https")
+		configSchema[prefix+"Relay"] = isBool
+	}
+}
+
+// ValidateConfig checks the whole config read by ReadConfig and returns all errors found
+func ValidateConfig(v *viper.Viper) []error {
+	var errs []error
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// unknown keys, viper itself is case insensitive
+	known := make(map[string]bool, len(configSchema))
+	for key := range configSchema {
+		known[strings.ToLower(key)] = true
+	}
+	keys, err := configKeys(v)
+	if err != nil {
+		return []error{err}
+	}
+	for _, item := range keys {
+		if key := fmt.Sprint(item.Key); !known[strings.ToLower(key)] {
+			addErr("%s: unknown key", key)
+		}
+	}
+
+	for _, key := range requiredKeys {
+		if !v.IsSet(key) {
+			addErr("%s: required", key)
+		}
+	}
+
+	names := make([]string, 0, len(configSchema))
+	for key := range configSchema {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		if !v.IsSet(key) {
+			continue
+		}
+		if err := configSchema[key](v.Get(key)); err != nil {
+			addErr("%s: %s", key, err)
+		}
+	}
+
+	// mutually exclusive and dependent options
+	if isWebsocketURL(v.GetString("primarySubmitURL")) && isWebsocketURL(v.GetString("secondarySubmitURL")) {
+		addErr("primarySubmitURL, secondarySubmitURL: only one chain can use the websocket api")
+	}
+	if (v.GetString("tlsCertFile") == "") != (v.GetString("tlsKeyFile") == "") {
+		addErr("tlsCertFile, tlsKeyFile: both or none must be set")
+	}
+	if v.GetString("tlsClientCAFile") != "" && v.GetString("tlsCertFile") == "" {
+		addErr("tlsClientCAFile: requires tlsCertFile and tlsKeyFile")
+	}
+	if v.GetString("logFile") != "" && v.GetBool("fileLogging") {
+		addErr("logFile, fileLogging: mutually exclusive, use logFile")
+	}
+	for _, prefix := range []string{"primary", "secondary"} {
+		if v.GetInt64(prefix+"Capacity") > 0 && v.GetBool(prefix+"CapacityPerAccount") {
+			addErr("%sCapacity, %sCapacityPerAccount: mutually exclusive", prefix, prefix)
+		}
+		if v.GetBool(prefix+"Relay") && v.GetString("relayName") == "" {
+			addErr("%sRelay: requires relayName", prefix)
+		}
+		if v.GetBool(prefix+"Relay") && isWebsocketURL(v.GetString(prefix+"SubmitURL")) {
+			addErr("%sRelay: the parent aggregator needs an http(s) %sSubmitURL", prefix, prefix)
+		}
+	}
+
+	// list entries
+	for _, prefix := range []string{"primary", "secondary"} {
+		for _, key := range []string{prefix + "AllowedAccounts", prefix + "DeniedAccounts"} {
+			var ids []uint64
+			if err := strictUnmarshal(v, key, &ids); err != nil {
+				addErr("%s: %s", key, err)
+			}
+		}
+	}
+	if windows, ok := v.Get("statsWindows").([]interface{}); ok {
+		for _, w := range windows {
+			if err := intRange(1, maxStatsWindow)(w); err != nil {
+				addErr("statsWindows: %s", err)
+			}
+		}
+	}
+	for _, s := range v.GetStringSlice("trustedProxies") {
+		if _, err := parseNetwork(s); err != nil {
+			addErr("trustedProxies: %s", err)
+		}
+	}
+	var overrides []RateQuota
+	if err := strictUnmarshal(v, "rateLimitOverrides", &overrides); err != nil {
+		addErr("rateLimitOverrides: %s", err)
+	}
+	for i, o := range overrides {
+		if _, err := parseNetwork(o.Network); err != nil {
+			addErr("rateLimitOverrides[%d]: %s", i, err)
+		}
+		if o.RateLimit <= 0 || o.BurstRate < 0 || o.SubmitRateLimit < 0 || o.SubmitBurstRate < 0 {
+			addErr("rateLimitOverrides[%d]: rateLimit must be positive, the other limits must not be negative", i)
+		}
+	}
+	var tokens []MinerToken
+	if err := strictUnmarshal(v, "minerTokens", &tokens); err != nil {
+		addErr("minerTokens: %s", err)
+	}
+	seen := make(map[string]bool, len(tokens))
+	for i, t := range tokens {
+		if t.Token == "" {
+			addErr("minerTokens[%d]: empty token", i)
+		} else if seen[t.Token] {
+			addErr("minerTokens[%d]: duplicate token", i)
+		}
+		seen[t.Token] = true
+	}
+	var relays []Relay
+	if err := strictUnmarshal(v, "relays", &relays); err != nil {
+		addErr("relays: %s", err)
+	}
+	relayNames := make(map[string]bool, len(relays))
+	for i, r := range relays {
+		if r.Name == "" || r.Token == "" {
+			addErr("relays[%d]: name and token required", i)
+		} else if relayNames[r.Name] {
+			addErr("relays[%d]: duplicate name %q", i, r.Name)
+		}
+		relayNames[r.Name] = true
+		if _, err := parseNetwork(r.Network); r.Network != "" && err != nil {
+			addErr("relays[%d].network: %s", i, err)
+		}
+		if r.MaxMiners < 0 || r.RateLimit < 0 || r.BurstRate < 0 || r.SubmitRateLimit < 0 || r.SubmitBurstRate < 0 {
+			addErr("relays[%d]: maxMiners and the limits must not be negative", i)
+		}
+	}
+	var listeners []ListenerConfig
+	if err := strictUnmarshal(v, "listeners", &listeners); err != nil {
+		addErr("listeners: %s", err)
+	}
+	for i, l := range listeners {
+		if err := listenAddress(l.Addr); err != nil {
+			addErr("listeners[%d].addr: %s", i, err)
+		}
+		if err := oneOf("primary", "secondary")(l.Chain); l.Chain != "" && err != nil {
+			addErr("listeners[%d].chain: %s", i, err)
+		}
+		if l.Chain == "secondary" && v.GetString("secondarySubmitURL") == "" {
+			addErr("listeners[%d].chain: requires secondarySubmitURL", i)
+		}
+		if err := oneOf("tokens", "none")(l.Auth); l.Auth != "" && err != nil {
+			addErr("listeners[%d].auth: %s", i, err)
+		}
+		if l.Auth == "tokens" && len(tokens) == 0 {
+			addErr("listeners[%d].auth: requires minerTokens", i)
+		}
+		if l.TLS && v.GetString("tlsCertFile") == "" {
+			addErr("listeners[%d].tls: requires tlsCertFile and tlsKeyFile", i)
+		}
+	}
+	var hooks []Webhook
+	if err := strictUnmarshal(v, "webhooks", &hooks); err != nil {
+		addErr("webhooks: %s", err)
+	}
+	for i, h := range hooks {
+		if err := urlScheme(false, "http", "https")(h.URL); err != nil {
+			addErr("webhooks[%d].url: %s", i, err)
+		}
+		if err := oneOf("json", "telegram", "discord")(h.Format); h.Format != "" && err != nil {
+			addErr("webhooks[%d].format: %s", i, err)
+		}
+		if h.Format == "telegram" && h.ChatID == "" {
+			addErr("webhooks[%d].chatId: required by telegram", i)
+		}
+		for _, e := range h.Events {
+			if err := oneOf(eventMinerOffline, eventMinerOnline, eventCapacityDrop, eventUpstreamDown, eventUpstreamUp,
+				eventChainStale, eventLiarDetected, eventBlockForged)(e); err != nil {
+				addErr("webhooks[%d].events: %s", i, err)
+			}
+		}
+	}
+	for subsystem, level := range v.GetStringMapString("logLevels") {
+		if err := oneOf(logSubsystems...)(subsystem); err != nil {
+			addErr("logLevels: subsystem %s", err)
+		}
+		if err := oneOf("debug", "info", "warn", "error")(level); err != nil {
+			addErr("logLevels.%s: %s", subsystem, err)
+		}
+	}
+	return errs
+}
+
+// strictUnmarshal decodes a structured key, rejecting unknown fields
+func strictUnmarshal(v *viper.Viper, key string, out interface{}) error {
+	err := v.UnmarshalKey(key, out, func(c *mapstructure.DecoderConfig) {
+		c.ErrorUnused = true
+	})
+	if merr, ok := err.(*mapstructure.Error); ok {
+		return errors.New(strings.Join(merr.Errors, "; "))
+	}
+	return err
+}
+
+// isWebsocketURL reports whether a submit url uses the websocket api
+func isWebsocketURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "ws" || u.Scheme == "wss")
+}
+
+func isString(v interface{}) error {
+	if _, ok := v.(string); !ok {
+		return fmt.Errorf("%v is not a string", v)
+	}
+	return nil
+}
+
+func isBool(v interface{}) error {
+	if _, ok := v.(bool); !ok {
+		return fmt.Errorf("%v is not true or false", v)
+	}
+	return nil
+}
+
+func isList(v interface{}) error {
+	if _, ok := v.([]interface{}); !ok && v != nil {
+		return fmt.Errorf("%v is not a list", v)
+	}
+	return nil
+}
+
+func isMap(v interface{}) error {
+	switch v.(type) {
+	case nil, map[string]interface{}, map[interface{}]interface{}:
+		return nil
+	}
+	return fmt.Errorf("%v is not a map", v)
+}
+
+// toFloat converts the numeric types yaml decodes to
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func intRange(min, max int64) check {
+	return func(v interface{}) error {
+		f, ok := toFloat(v)
+		if !ok || f != math.Trunc(f) {
+			return fmt.Errorf("%v is not an integer", v)
+		}
+		if f < float64(min) || f > float64(max) {
+			return fmt.Errorf("%v is out of range [%d, %d]", v, min, max)
+		}
+		return nil
+	}
+}
+
+func floatRange(min, max float64) check {
+	return func(v interface{}) error {
+		f, ok := toFloat(v)
+		if !ok {
+			return fmt.Errorf("%v is not a number", v)
+		}
+		if f < min || f > max {
+			return fmt.Errorf("%v is out of range [%g, %g]", v, min, max)
+		}
+		return nil
+	}
+}
+
+func oneOf(values ...string) check {
+	return func(v interface{}) error {
+		for _, value := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+// listenAddress checks for host:port or unix:path
+func listenAddress(v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%v is not a string", v)
+	}
+	if path := strings.TrimPrefix(s, unixPrefix); path != s {
+		if path == "" {
+			return fmt.Errorf("%q has no socket path", s)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return err
+	}
+	return nil
+}
+
+// urlScheme checks for an absolute url with a host and one of the schemes
+func urlScheme(optional bool, schemes ...string) check {
+	return func(v interface{}) error {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%v is not a string", v)
+		}
+		if s == "" {
+			if optional {
+				return nil
+			}
+			return fmt.Errorf("url required")
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Host == "" {
+			return fmt.Errorf("%q has no host", s)
+		}
+		for _, scheme := range schemes {
+			if u.Scheme == scheme {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q: scheme must be one of %s", s, strings.Join(schemes, ", "))
+	}
+}
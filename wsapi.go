@@ -1,37 +1,81 @@
-package main
+package aggregator
 
 import (
-	"fmt"
+	"context"
 	"encoding/json"
-	"log"
-
-	"time"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"sync"
-	"os"
-	"github.com/mariuspass/recws"
-	"strconv"
-	"os/signal"
+	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+)
+
+const (
+	hdproxyVersion   = "20190423"
+	threshold        = 30
+	frequency        = 5
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 10 * time.Second
+	reconnectMin     = 1 * time.Second
+	reconnectMax     = 60 * time.Second
 )
 
+// websocket connection states
 const (
-	hdproxyVersion = "20190423"
-	threshold      = 30
-	frequency	   = 5
+	wsConnecting wsState = iota // dialing, never subscribed so far
+	wsSubscribed                // connected and subscribed, mining info is live
+	wsDegraded                  // connection or heartbeat lost, reconnecting
+	wsClosed                    // closed by the proxy
 )
 
-var currentMiningInfo atomic.Value
-var lastHeartBeat atomic.Value
-var available atomicBool
+var errNotConnected = errors.New("websocket: not connected")
+
+type wsState int32
+
+func (s wsState) String() string {
+	switch s {
+	case wsConnecting:
+		return "connecting"
+	case wsSubscribed:
+		return "subscribed"
+	case wsDegraded:
+		return "degraded"
+	case wsClosed:
+		return "closed"
+	}
+	return "unknown"
+}
 
 type websocketAPI struct {
-	server     string
-	accountKey string
-	rc         *recws.RecConn
-	ci         clientInfo
-	sendMu     *sync.Mutex // Prevent "concurrent write to websocket connection"
-	receiveMu  *sync.Mutex
+	server      string
+	accountKey  string
+	dialer      *websocket.Dialer
+	conn        *websocket.Conn
+	connMu      *sync.Mutex
+	state       int32
+	notifyMu    *sync.Mutex
+	notifyCh    chan struct{} // closed and replaced on every state or mining info change
+	ctx         context.Context
+	cancel      context.CancelFunc
+	ci          clientInfo
+	ciMu        *sync.Mutex
+	sendMu      *sync.Mutex // Prevent "concurrent write to websocket connection"
+	batchWindow time.Duration
+	batchMu     *sync.Mutex
+	batch       map[batchKey]nonceData
+
+	miningInfo    atomic.Value
+	lastHeartBeat atomic.Value
+}
+
+// batchKey identifies a pending submission, only the best deadline per account and height is kept
+type batchKey struct {
+	accountID uint64
+	height    uint64
 }
 
 type clientInfo struct {
@@ -72,155 +116,273 @@ type websocketMessage struct {
 	Para interface{} `json:"para"`
 }
 
-func newWebsocketAPI(server string, accountKey string, minerName string, capacityGB int64) (c *websocketAPI) {
-	ws := recws.RecConn{}
+func newWebsocketAPI(server string, accountKey string, minerName string, capacityGB int64, batchWindow time.Duration, dial dialFunc) (c *websocketAPI) {
 	ci := clientInfo{accountKey, minerName, minerName + ".hdproxy.exe." + hdproxyVersion, capacityGB}
+	ctx, cancel := context.WithCancel(context.Background())
 	c = &websocketAPI{
-		server,
-		accountKey,
-		&ws,
-		ci,
-		&sync.Mutex{},
-		&sync.Mutex{}}
+		server:      server,
+		accountKey:  accountKey,
+		dialer:      &websocket.Dialer{HandshakeTimeout: handshakeTimeout, NetDial: dial},
+		connMu:      &sync.Mutex{},
+		notifyMu:    &sync.Mutex{},
+		notifyCh:    make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		ci:          ci,
+		ciMu:        &sync.Mutex{},
+		sendMu:      &sync.Mutex{},
+		batchWindow: batchWindow,
+		batchMu:     &sync.Mutex{},
+		batch:       make(map[batchKey]nonceData),
+	}
 	return
 }
 
-func (c *websocketAPI) UpdateSize(totalSize int64){
-	c.sendMu.Lock()
+// State returns the current connection state
+func (c *websocketAPI) State() wsState {
+	return wsState(atomic.LoadInt32(&c.state))
+}
+
+// setState changes the connection state, a closed api stays closed
+func (c *websocketAPI) setState(s wsState) {
+	for {
+		old := wsState(atomic.LoadInt32(&c.state))
+		if old == s || old == wsClosed {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.state, int32(old), int32(s)) {
+			logWebsocket.Info("State changed", "from", old, "to", s)
+			c.notify()
+			return
+		}
+	}
+}
+
+// changed returns a channel that is closed on the next state or mining info change
+func (c *websocketAPI) changed() <-chan struct{} {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	return c.notifyCh
+}
+
+func (c *websocketAPI) notify() {
+	c.notifyMu.Lock()
+	close(c.notifyCh)
+	c.notifyCh = make(chan struct{})
+	c.notifyMu.Unlock()
+}
+
+// MiningInfo returns the latest mining info, only while subscribed, stale info is never handed out
+func (c *websocketAPI) MiningInfo() (*miningInfo, bool) {
+	if c.State() != wsSubscribed {
+		return nil, false
+	}
+	mi, _ := c.miningInfo.Load().(*miningInfo)
+	return mi, mi != nil
+}
+
+func (c *websocketAPI) UpdateSize(totalSize int64) {
+	c.ciMu.Lock()
 	c.ci.Capacity = totalSize
-	c.sendMu.Unlock()
+	c.ciMu.Unlock()
+}
+
+func (c *websocketAPI) currentClientInfo() clientInfo {
+	c.ciMu.Lock()
+	defer c.ciMu.Unlock()
+	return c.ci
 }
 
+// Close stops reconnecting and closes the connection
 func (c *websocketAPI) Close() {
-	c.rc.Close()
+	c.cancel()
+	c.closeConn()
+	c.setState(wsClosed)
+}
+
+func (c *websocketAPI) closeConn() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
 }
 
+// Connect starts the connection loop in the background and waits a moment for the initial mining info
 func (c *websocketAPI) Connect() {
-	c.rc.SubscribeHandler = c.subscribe
-	c.rc.Dial(c.server, nil)
-
-	// message handler
-	go func() {
-		for {
-			c.receiveMu.Lock()
-			messageType, message, err := c.rc.ReadMessage()
-			c.receiveMu.Unlock()
-			if err != nil {
-				continue
-			}
-			// handle all text messages
-			switch messageType {
-			case 1:
-				onTextMessage(string(message))
+	go c.run()
+	timeout := time.NewTimer(handshakeTimeout)
+	defer timeout.Stop()
+	for {
+		changed := c.changed()
+		if _, ok := c.MiningInfo(); ok || c.State() == wsClosed {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return
+		}
+	}
+}
 
+// run dials, subscribes and serves the connection until the api is closed, reconnecting with exponential backoff
+func (c *websocketAPI) run() {
+	b := &backoff.Backoff{Min: reconnectMin, Max: reconnectMax, Factor: 2, Jitter: true}
+	for {
+		if c.ctx.Err() != nil {
+			return
+		}
+		conn, _, err := c.dialer.DialContext(c.ctx, c.server, nil)
+		if err == nil {
+			c.connMu.Lock()
+			// Close may have run while dialing, the connection must not outlive it
+			if c.ctx.Err() != nil {
+				c.connMu.Unlock()
+				conn.Close()
+				return
 			}
+			c.conn = conn
+			c.connMu.Unlock()
+			err = c.subscribe()
+			if err == nil {
+				b.Reset()
+				c.setState(wsSubscribed)
+				err = c.serve(conn)
+			}
+			c.closeConn()
+			// mining info of a lost connection must not be served after resubscribing
+			c.miningInfo.Store((*miningInfo)(nil))
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		if c.State() == wsSubscribed {
+			c.setState(wsDegraded)
 		}
-	}()
+		wait := b.Duration()
+		logWebsocket.Warn("Connection failed", "err", err, "reconnectIn", wait)
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return
+		}
+	}
 }
 
-func (c *websocketAPI) subscribe() error {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+// serve reads messages until the connection fails or the heartbeat is lost
+func (c *websocketAPI) serve(conn *websocket.Conn) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go c.heartbeat(ctx, conn)
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		// handle all text messages
+		if messageType == websocket.TextMessage {
+			c.onTextMessage(string(message))
+		}
+	}
+}
 
+func (c *websocketAPI) subscribe() error {
+	c.lastHeartBeat.Store(time.Now())
 	// request initial mining info
-	c.sendMu.Lock()
-	if err := c.rc.WriteMessage(1, []byte("{\"cmd\":\"mining_info\",\"para\":{}}")); err != nil {
-		log.Printf("Error: WriteMessage %s", c.rc.GetURL())
-		return err
+	if err := c.write([]byte("{\"cmd\":\"mining_info\",\"para\":{}}")); err != nil {
+		return fmt.Errorf("request mining info: %s", err)
 	}
-	c.sendMu.Unlock()
 	// subscribe for future mining infos
 	channelName := "poolmgr.mining_info"
 	subscribeObject := getSubscribeEventObject(channelName, 0)
 	subscribeData := serializeDataIntoString(subscribeObject)
-	c.sendMu.Lock()
-	if err := c.rc.WriteMessage(1, []byte(subscribeData)); err != nil {
-		log.Printf("Error: WriteMessage %s", c.rc.GetURL())
-		return err
+	if err := c.write([]byte(subscribeData)); err != nil {
+		return fmt.Errorf("subscribe mining info: %s", err)
 	}
-	c.sendMu.Unlock()
-	// subscribe to heartbeat
-	// cancel existing
-	// create new
-	ct := time.Now()
-	lastHeartBeat.Store(ct)
+	return nil
+}
+
+// heartbeat sends heartbeats and closes the connection if the pool stops answering them or the api is closed
+func (c *websocketAPI) heartbeat(ctx context.Context, conn *websocket.Conn) {
 	ticker := time.NewTicker(time.Duration(frequency) * time.Second)
-	go func() {
-		for {
+	defer ticker.Stop()
+	for {
 		select {
-			case <- ticker.C:
-				// check last heartbeatACK
-				ht := lastHeartBeat.Load()
-				if int64(time.Now().Sub(ht.(time.Time)).Seconds()) > threshold {
-					// attempt reconnect
-					// stop heartbeat, will be restarted after connect
-					ticker.Stop();
-					log.Println("websocket api: heartbeat lost, trying to reconnect...")
-					ct := time.Now()
-					lastHeartBeat.Store(ct)
-					c.Close()					
-				}
-				c.sendMu.Lock()
-				ci := clientInfo{c.accountKey,c.ci.MinerName,c.ci.MinerName+".hdproxy.exe."+hdproxyVersion, c.ci.Capacity}
-				hb := websocketMessage{"poolmgr.heartbeat",ci}
-				req, err := jsonx.MarshalToString(&hb);
-				if err != nil {
-					return
-				}
-				// debug
-				// log.Println(req)
-				c.rc.WriteMessage(1, []byte(req))
-				c.sendMu.Unlock()
-			case <- interrupt:
-				ticker.Stop()
-				os.Exit(0)
+		case <-ticker.C:
+			// check last heartbeatACK
+			ht := c.lastHeartBeat.Load().(time.Time)
+			if int64(time.Now().Sub(ht).Seconds()) > threshold {
+				logWebsocket.Warn("Heartbeat lost, reconnecting")
+				c.setState(wsDegraded)
+				// unblocks the read loop, run will reconnect
+				conn.Close()
 				return
 			}
+			ci := c.currentClientInfo()
+			ci.AccountKey = c.accountKey
+			ci.MinerMark = ci.MinerName + ".hdproxy.exe." + hdproxyVersion
+			hb := websocketMessage{"poolmgr.heartbeat", ci}
+			req, err := jsonx.MarshalToString(&hb)
+			if err != nil {
+				return
+			}
+			if err := c.write([]byte(req)); err != nil {
+				logWebsocket.Warn("Heartbeat failed", "err", err)
+			}
+		case <-ctx.Done():
+			// unblocks the read loop once the api is closed
+			conn.Close()
+			return
 		}
-	}()
+	}
+}
+
+// write sends a text message, a failed write closes the connection so that run reconnects
+func (c *websocketAPI) write(data []byte) error {
+	c.connMu.Lock()
+	conn := c.conn
+	c.connMu.Unlock()
+	if conn == nil {
+		return errNotConnected
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		conn.Close()
+		return err
+	}
 	return nil
 }
 
-func onTextMessage(message string) {
-	// debug log.Println("recv (text):", message)
+func (c *websocketAPI) onTextMessage(message string) {
 	var hi websocketMessage
-			if err := jsonx.UnmarshalFromString(message, &hi); err != nil {
-				return
-			}
-		switch hi.Cmd{
-		case "poolmgr.heartbeat": 
-			ct := time.Now()
-			lastHeartBeat.Store(ct)
-			//log.Println("websocket api: heartbeat");
-		case "poolmgr.mining_info":
-			var mi websocketMiningInfo
-			if err := jsonx.UnmarshalFromString(message, &mi); err != nil {
-				return
-			}
-			mi.Para.bytes, _ = json.Marshal(map[string]string{
-				"height":              fmt.Sprintf("%d", mi.Para.Height),
-				"baseTarget":          fmt.Sprintf("%d", mi.Para.BaseTarget),
-				"generationSignature": mi.Para.GenSig})
-			mi.Para.StartTime = time.Now()
-			currentMiningInfo.Store(&mi.Para)
-			available.Set(true)
-			log.Println("websocket api: new mining info received");
-		case "mining_info":
-			var mi websocketMiningInfo
-			mi.Para.StartTime = time.Now()
-			if err := jsonx.UnmarshalFromString(message, &mi); err != nil {
-				return
-			}
-			mi.Para.bytes, _ = json.Marshal(map[string]string{
-				"height":              fmt.Sprintf("%d", mi.Para.Height),
-				"baseTarget":          fmt.Sprintf("%d", mi.Para.BaseTarget),
-				"generationSignature": mi.Para.GenSig})
-			mi.Para.StartTime = time.Now()
-			currentMiningInfo.Store(&mi.Para)
-			available.Set(true)
-			log.Println("websocket api: initial mining info received.");
+	if err := jsonx.UnmarshalFromString(message, &hi); err != nil {
 		return
+	}
+	switch hi.Cmd {
+	case "poolmgr.heartbeat":
+		c.lastHeartBeat.Store(time.Now())
+	case "poolmgr.mining_info", "mining_info":
+		var mi websocketMiningInfo
+		if err := jsonx.UnmarshalFromString(message, &mi); err != nil {
+			return
+		}
+		mi.Para.bytes, _ = json.Marshal(map[string]string{
+			"height":              fmt.Sprintf("%d", mi.Para.Height),
+			"baseTarget":          fmt.Sprintf("%d", mi.Para.BaseTarget),
+			"generationSignature": mi.Para.GenSig})
+		mi.Para.StartTime = time.Now()
+		c.miningInfo.Store(&mi.Para)
+		c.notify()
+		if hi.Cmd == "mining_info" {
+			logWebsocket.Info("Initial mining info received")
+		} else {
+			logWebsocket.Debug("New mining info received")
 		}
+	}
 }
 
 func getSubscribeEventObject(channelName string, messageID int) emitEvent {
@@ -247,17 +409,51 @@ func serializeDataIntoString(data interface{}) string {
 	return string(b)
 }
 
-func (c *websocketAPI) submitNonce(accountID uint64, height uint64, nonce uint64, deadline uint64){
-	c.sendMu.Lock()
-	nd := nonceData{accountID, height, strconv.FormatUint(nonce,10), deadline, time.Now().Unix()}
-	ns := nonceSubmission{c.ci.AccountKey,c.ci.MinerName,"",c.ci.Capacity,[]nonceData{nd}}
-	hb := websocketMessage{"poolmgr.submit_nonce",ns}
-	req, err := jsonx.MarshalToString(&hb);
-	// debug
-	// log.Println(req)
+func (c *websocketAPI) submitNonce(accountID uint64, height uint64, nonce uint64, deadline uint64) {
+	nd := nonceData{accountID, height, strconv.FormatUint(nonce, 10), deadline, time.Now().Unix()}
+	if c.batchWindow <= 0 {
+		c.sendNonces([]nonceData{nd})
+		return
+	}
+
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+	key := batchKey{accountID, height}
+	if existing, exists := c.batch[key]; exists && existing.Deadline <= deadline {
+		return
+	}
+	// first submission of a window schedules the flush
+	if len(c.batch) == 0 {
+		time.AfterFunc(c.batchWindow, c.flushNonces)
+	}
+	c.batch[key] = nd
+}
+
+// flushNonces sends all pending submissions as a single message
+func (c *websocketAPI) flushNonces() {
+	c.batchMu.Lock()
+	if len(c.batch) == 0 {
+		c.batchMu.Unlock()
+		return
+	}
+	nds := make([]nonceData, 0, len(c.batch))
+	for key, nd := range c.batch {
+		nds = append(nds, nd)
+		delete(c.batch, key)
+	}
+	c.batchMu.Unlock()
+	c.sendNonces(nds)
+}
+
+func (c *websocketAPI) sendNonces(nds []nonceData) {
+	ci := c.currentClientInfo()
+	ns := nonceSubmission{ci.AccountKey, ci.MinerName, "", ci.Capacity, nds}
+	hb := websocketMessage{"poolmgr.submit_nonce", ns}
+	req, err := jsonx.MarshalToString(&hb)
 	if err != nil {
 		return
 	}
-	c.rc.WriteMessage(1, []byte(req))
-	c.sendMu.Unlock()
+	if err := c.write([]byte(req)); err != nil {
+		logWebsocket.Error("Submission failed", "nonces", len(nds), "err", err)
+	}
 }